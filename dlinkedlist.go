@@ -173,6 +173,21 @@ func (l *List) InsertByPriority(v any, p int) *Element {
 	return l.insert(e, l.Back())
 }
 
+// InsertByPriorityFirst inserts e based on priority, ahead of any elements of equal priority
+func (l *List) InsertByPriorityFirst(v any, p int) *Element {
+	l.lazyInit()
+	e := &Element{Value: v, Priority: p}
+	if l.len == 0 {
+		return l.insert(e, &l.root)
+	}
+	for i, _ := l.FrontAndCheck(); i != nil; i = i.Next() {
+		if i.Priority >= e.Priority {
+			return l.insertBefore(e, i)
+		}
+	}
+	return l.insert(e, l.Back())
+}
+
 // InsertByDateTime inserts e based on DateTime
 func (l *List) InsertByDateTime(v any, t time.Time) *Element {
 	l.lazyInit()
@@ -0,0 +1,161 @@
+package qsutils
+
+import (
+	"sort"
+	"time"
+)
+
+// inflightMessage is a message delivered to a client that has not been acknowledged yet
+type inflightMessage struct {
+	message NotificationServiceMessage
+	timer   *time.Timer // nil if the message waits for the next poll, see AckTimeout
+}
+
+func (m *inflightMessage) stopTimer() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
+
+// Ack acknowledges processed messages. The reply is the number of messages that were still waiting for an acknowledgement.
+func (t *NotificationService) Ack(ack NotificationAck, reply *int) error {
+
+	clientID, err := t.clientID(ack.ClientID)
+	if err != nil {
+		return err
+	}
+
+	*reply = t.server.Ack(clientID, ack.MessageIDs...)
+
+	return nil
+}
+
+// Ack marks the messages as processed by the client so they are not redelivered. It returns
+// the number of messages that were waiting for an acknowledgement.
+func (s *NotificationServer) Ack(clientID string, messageIDs ...uint64) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return 0
+	}
+	s.touchLocked(entry)
+
+	acked := 0
+	for _, id := range messageIDs {
+		if inflight, ok := entry.inflight[id]; ok {
+			inflight.stopTimer()
+			delete(entry.inflight, id)
+			s.unpersistLocked(clientID, id)
+			acked++
+		}
+	}
+
+	return acked
+}
+
+// RedeliveryCount returns the number of times messages have been redelivered to the client
+func (s *NotificationServer) RedeliveryCount(clientID string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.clients[clientID]; ok {
+		return entry.redeliveries
+	}
+	return 0
+}
+
+func (s *NotificationServer) trackInflightLocked(entry *notificationClientEntry, message NotificationServiceMessage) {
+
+	clientID, id, attempt := entry.info.ClientID, message.ID, message.DeliveryAttempt
+
+	if previous, ok := entry.inflight[id]; ok {
+		previous.stopTimer()
+	}
+
+	inflight := &inflightMessage{message: message}
+	if s.AckTimeout > 0 {
+		inflight.timer = time.AfterFunc(s.AckTimeout, func() {
+			s.ackExpired(clientID, id, attempt)
+		})
+	}
+	entry.inflight[id] = inflight
+}
+
+// ackExpired puts a message that was not acknowledged in time back at the front of the backlog
+func (s *NotificationServer) ackExpired(clientID string, id uint64, attempt int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return
+	}
+	inflight, ok := entry.inflight[id]
+	if !ok || inflight.message.DeliveryAttempt != attempt {
+		return
+	}
+
+	delete(entry.inflight, id)
+	s.requeueLocked(entry, inflight.message)
+
+	if entry.listener != nil {
+		s.processBacklogLocked(entry)
+	}
+}
+
+// requeueInflightLocked moves every unacknowledged message back to the front of the backlog, oldest first
+func (s *NotificationServer) requeueInflightLocked(entry *notificationClientEntry) {
+
+	messages := entry.inflightInOrder()
+	entry.stopInflightTimers()
+	entry.inflight = make(map[uint64]*inflightMessage)
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		s.requeueLocked(entry, messages[i])
+	}
+}
+
+// requeueLocked puts the message at the front of the backlog, or hands it to the dead letter
+// handler if it has used up its delivery attempts
+func (s *NotificationServer) requeueLocked(entry *notificationClientEntry, message NotificationServiceMessage) {
+
+	if s.MaxDeliveryAttempts > 0 && message.DeliveryAttempt >= s.MaxDeliveryAttempts {
+		s.unpersistLocked(entry.info.ClientID, message.ID)
+		s.metrics.countDroppedLocked(dropDeadLetter, 1)
+		if s.DeadLetterHandler != nil {
+			go s.DeadLetterHandler(entry.info.ClientID, message)
+		}
+		return
+	}
+
+	if message.Expired(time.Now()) {
+		s.metrics.countDroppedLocked(dropExpired, 1)
+		s.unpersistLocked(entry.info.ClientID, message.ID)
+		return
+	}
+
+	entry.redeliveries++
+	s.metrics.redelivered++
+	entry.pushBacklogFront(message)
+}
+
+func (c *notificationClientEntry) stopInflightTimers() {
+	for _, inflight := range c.inflight {
+		inflight.stopTimer()
+	}
+}
+
+// inflightInOrder returns the unacknowledged messages in the order they were sent
+func (c *notificationClientEntry) inflightInOrder() []NotificationServiceMessage {
+	messages := make([]NotificationServiceMessage, 0, len(c.inflight))
+	for _, inflight := range c.inflight {
+		messages = append(messages, inflight.message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages
+}
@@ -0,0 +1,106 @@
+package qsutils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func ackClient() NotificationClient {
+	return NotificationClient{ClientID: "a", Acknowledge: true}
+}
+
+// pollBriefly polls for the client, returning false if nothing is delivered within a short wait
+func pollBriefly(s *NotificationServer, client NotificationClient) (NotificationServiceMessage, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	message, err := s.listenContext(ctx, client, false)
+	return message, err == nil
+}
+
+func TestUnacknowledgedMessageRedeliveredOnNextPoll(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.AckTimeout = 0
+	if _, err := s.Register(ackClient()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := s.listen(ackClient())
+	second := s.listen(ackClient())
+	if second.ID != first.ID || second.DeliveryAttempt != 2 {
+		t.Fatalf("second poll returned message %d attempt %d, want message %d attempt 2", second.ID, second.DeliveryAttempt, first.ID)
+	}
+	if count := s.RedeliveryCount("a"); count != 1 {
+		t.Fatalf("RedeliveryCount is %d, want 1", count)
+	}
+
+	if acked := s.Ack("a", second.ID); acked != 1 {
+		t.Fatalf("Ack returned %d, want 1", acked)
+	}
+	if message, ok := pollBriefly(s, ackClient()); ok {
+		t.Fatalf("acknowledged message %d delivered again", message.ID)
+	}
+}
+
+func TestUnacknowledgedMessageRequeuedAfterAckTimeout(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.AckTimeout = 20 * time.Millisecond
+	if _, err := s.Register(ackClient()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := s.listenContext(context.Background(), ackClient(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	backlog, err := s.Backlog("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].ID != message.ID {
+		t.Fatalf("backlog is %v, want message %d back after the ack timeout", backlog, message.ID)
+	}
+}
+
+func TestMessageDeadLetteredAfterMaxDeliveryAttempts(t *testing.T) {
+
+	deadLetters := make(chan NotificationServiceMessage, 1)
+
+	s := NewNotificationServer(nil)
+	s.AckTimeout = 0
+	s.MaxDeliveryAttempts = 2
+	s.DeadLetterHandler = func(clientID string, message NotificationServiceMessage) {
+		deadLetters <- message
+	}
+	if _, err := s.Register(ackClient()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.listen(ackClient())
+	last := s.listen(ackClient())
+	if message, ok := pollBriefly(s, ackClient()); ok {
+		t.Fatalf("message %d delivered after %d attempts", message.ID, message.DeliveryAttempt-1)
+	}
+
+	select {
+	case message := <-deadLetters:
+		if message.ID != last.ID || message.DeliveryAttempt != 2 {
+			t.Fatalf("dead letter is message %d attempt %d, want message %d attempt 2", message.ID, message.DeliveryAttempt, last.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DeadLetterHandler not called")
+	}
+}
@@ -0,0 +1,255 @@
+package qsutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid client query")
+
+// Disable makes the server answer every poll with DISABLED until Enable is called
+func (s *NotificationServer) Disable() {
+	s.disabled.Store(true)
+}
+
+// Enable resumes delivery after Disable
+func (s *NotificationServer) Enable() {
+	s.disabled.Store(false)
+}
+
+// Disabled reports whether the server has been disabled
+func (s *NotificationServer) Disabled() bool {
+	return s.disabled.Load()
+}
+
+// Clients returns the registered clients that match the selector, or all of them if it is nil, ordered by ID
+func (s *NotificationServer) Clients(selector *ClientSelector) []NotificationClientInfo {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make([]NotificationClientInfo, 0, len(s.clients))
+	for _, entry := range s.clients {
+		if selector == nil || selector.Match(entry.info.Properties) {
+			clients = append(clients, entry.clientInfo())
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+
+	return clients
+}
+
+// Client returns what the server knows about the client
+func (s *NotificationServer) Client(clientID string) (NotificationClientInfo, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return NotificationClientInfo{}, ErrUnknownClient
+	}
+
+	return entry.clientInfo(), nil
+}
+
+// Backlog returns a copy of the messages queued for the client, in delivery order. Messages that
+// have been delivered and are waiting for an acknowledgement are not included.
+func (s *NotificationServer) Backlog(clientID string) ([]NotificationServiceMessage, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return nil, ErrUnknownClient
+	}
+
+	messages := make([]NotificationServiceMessage, 0, entry.backlog.Len())
+	for e := entry.backlog.Front(); e != nil; e = e.Next() {
+		messages = append(messages, e.Value.(NotificationServiceMessage))
+	}
+
+	return messages, nil
+}
+
+func (c *notificationClientEntry) clientInfo() NotificationClientInfo {
+
+	state := PollIdle
+	switch {
+	case c.listener != nil:
+		state = PollWaiting
+	case c.expired:
+		state = PollExpired
+	}
+
+	return NotificationClientInfo{
+		ClientID:          c.info.ClientID,
+		ProcessID:         c.info.ProcessID,
+		Properties:        c.info.Properties,
+		Topics:            c.topicList(),
+		Acknowledge:       c.info.Acknowledge,
+		LastSeen:          c.lastSeen,
+		HeartbeatInterval: c.heartbeat,
+		PollState:         state,
+		BacklogMessages:   c.backlog.Len(),
+		BacklogBytes:      c.backlogBytes,
+		InflightMessages:  len(c.inflight),
+		Paused:            c.paused,
+	}
+}
+
+// The admin methods of NotificationService require a token with PermissionAdmin. A server
+// without an Authenticator cannot tell an administrator from anyone else, so it refuses them.
+// ClearBacklog and Disconnect already let an administrator act for any client.
+
+// allowAdmin checks that the caller of an admin operation is an administrator
+func (s *NotificationServer) allowAdmin(session *clientSession) error {
+	if s.Authenticator == nil {
+		return fmt.Errorf("%w: admin operations require an Authenticator", ErrPermissionDenied)
+	}
+	return session.allow(PermissionAdmin)
+}
+
+// Clients lists the registered clients that match the selector of the query
+func (t *NotificationService) Clients(query NotificationClientQuery, reply *[]NotificationClientInfo) error {
+
+	if err := t.server.allowAdmin(t.session); err != nil {
+		return err
+	}
+
+	clients, err := t.server.queryClients(query)
+	if err != nil {
+		return err
+	}
+	*reply = clients
+
+	return nil
+}
+
+// Client describes a single client
+func (t *NotificationService) Client(clientID string, reply *NotificationClientInfo) error {
+
+	if err := t.server.allowAdmin(t.session); err != nil {
+		return err
+	}
+
+	info, err := t.server.Client(clientID)
+	if err != nil {
+		return err
+	}
+	*reply = info
+
+	return nil
+}
+
+// Backlog returns the messages queued for the client
+func (t *NotificationService) Backlog(clientID string, reply *[]NotificationServiceMessage) error {
+
+	if err := t.server.allowAdmin(t.session); err != nil {
+		return err
+	}
+
+	messages, err := t.server.Backlog(clientID)
+	if err != nil {
+		return err
+	}
+	*reply = messages
+
+	return nil
+}
+
+// SetDisabled disables or enables the server, as Disable and Enable do in process. The reply is the new state.
+func (t *NotificationService) SetDisabled(disabled bool, reply *bool) error {
+
+	if err := t.server.allowAdmin(t.session); err != nil {
+		return err
+	}
+
+	if disabled {
+		t.server.Disable()
+	} else {
+		t.server.Enable()
+	}
+	*reply = t.server.Disabled()
+
+	return nil
+}
+
+func (s *NotificationServer) queryClients(query NotificationClientQuery) ([]NotificationClientInfo, error) {
+
+	if query.Selector == "" {
+		return s.Clients(nil), nil
+	}
+
+	selector, err := ParseClientSelector(query.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	return s.Clients(selector), nil
+}
+
+// EnableAdminAPI serves the admin operations as a JSON API under prefix, in the style of EnableHTTPAPI.
+// Every endpoint requires a token with PermissionAdmin, so the API answers 403 to everything on
+// a server without an Authenticator.
+//
+//	prefix/clients     NotificationClientQuery   -> []NotificationClientInfo
+//	prefix/client      NotificationRegistration  -> NotificationClientInfo
+//	prefix/backlog     NotificationRegistration  -> []NotificationServiceMessage
+//	prefix/purge       NotificationRegistration  -> NotificationServiceMessage
+//	prefix/disconnect  NotificationRegistration  -> NotificationServiceMessage
+//	prefix/pause       NotificationPauseRequest  -> {"clients": [...]}
+//	prefix/resume      NotificationPauseRequest  -> {"clients": [...]}
+//	prefix/disable     {}                        -> {"disabled": true}
+//	prefix/enable      {}                        -> {"disabled": false}
+func (s *NotificationServer) EnableAdminAPI(prefix string) {
+
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	s.mux.HandleFunc(prefix+"/clients", s.withSession(apiEndpoint(adminOnly(s, s.adminClients))))
+	s.mux.HandleFunc(prefix+"/client", s.withSession(apiEndpoint(adminOnly(s, s.adminClient))))
+	s.mux.HandleFunc(prefix+"/backlog", s.withSession(apiEndpoint(adminOnly(s, s.adminBacklog))))
+	s.mux.HandleFunc(prefix+"/purge", s.withSession(apiEndpoint(adminOnly(s, s.apiClear))))
+	s.mux.HandleFunc(prefix+"/disconnect", s.withSession(apiEndpoint(adminOnly(s, s.apiDisconnect))))
+	s.mux.HandleFunc(prefix+"/pause", s.withSession(apiEndpoint(adminOnly(s, s.adminSetPaused(true)))))
+	s.mux.HandleFunc(prefix+"/resume", s.withSession(apiEndpoint(adminOnly(s, s.adminSetPaused(false)))))
+	s.mux.HandleFunc(prefix+"/disable", s.withSession(apiEndpoint(adminOnly(s, s.adminSetDisabled(true)))))
+	s.mux.HandleFunc(prefix+"/enable", s.withSession(apiEndpoint(adminOnly(s, s.adminSetDisabled(false)))))
+}
+
+// adminOnly checks that the caller of an API operation holds PermissionAdmin
+func adminOnly[T any](s *NotificationServer, operation func(ctx context.Context, request T) (any, error)) func(ctx context.Context, request T) (any, error) {
+	return func(ctx context.Context, request T) (any, error) {
+		if err := s.allowAdmin(sessionFromContext(ctx)); err != nil {
+			return nil, err
+		}
+		return operation(ctx, request)
+	}
+}
+
+func (s *NotificationServer) adminClients(ctx context.Context, query NotificationClientQuery) (any, error) {
+	return s.queryClients(query)
+}
+
+func (s *NotificationServer) adminClient(ctx context.Context, registration NotificationRegistration) (any, error) {
+	return s.Client(registration.ClientID)
+}
+
+func (s *NotificationServer) adminBacklog(ctx context.Context, registration NotificationRegistration) (any, error) {
+	return s.Backlog(registration.ClientID)
+}
+
+func (s *NotificationServer) adminSetDisabled(disabled bool) func(ctx context.Context, _ struct{}) (any, error) {
+	return func(ctx context.Context, _ struct{}) (any, error) {
+		if disabled {
+			s.Disable()
+		} else {
+			s.Enable()
+		}
+		return map[string]bool{"disabled": s.Disabled()}, nil
+	}
+}
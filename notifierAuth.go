@@ -0,0 +1,339 @@
+package qsutils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnauthenticated = errors.New("authentication required")
+var ErrPermissionDenied = errors.New("permission denied")
+var ErrNoSecret = errors.New("HMAC authenticator has no secret")
+
+// Permission is a set of operations a caller is allowed
+type Permission uint
+
+const (
+	// PermissionListen allows polling for, acknowledging, subscribing, clearing and
+	// disconnecting the client named by the principal, and no other
+	PermissionListen Permission = 1 << iota
+
+	// PermissionSend allows sending to a client named by its ID
+	PermissionSend
+
+	// PermissionBroadcast allows sending to many clients at once: a topic, a selector or every client
+	PermissionBroadcast
+
+	// PermissionAdmin allows everything, for any client
+	PermissionAdmin
+)
+
+// Principal is an authenticated caller
+type Principal struct {
+	ClientID    string // the client a listener acts for
+	Permissions Permission
+}
+
+// Has reports whether the principal holds the permission
+func (p Principal) Has(permission Permission) bool {
+	return p.Permissions&PermissionAdmin != 0 || p.Permissions&permission == permission
+}
+
+// Authenticator checks the token presented by a caller and returns who it is
+type Authenticator interface {
+	Authenticate(token string) (Principal, error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to an Authenticator
+type AuthenticatorFunc func(token string) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(token string) (Principal, error) {
+	return f(token)
+}
+
+// HMACAuthenticator authenticates tokens it issued itself, signed with a secret shared by
+// everyone allowed to issue tokens. Without a secret it neither issues nor accepts any token.
+type HMACAuthenticator struct {
+	Secret []byte
+}
+
+type hmacClaims struct {
+	ClientID    string     `json:"sub,omitempty"`
+	Permissions Permission `json:"perm"`
+	ExpiresAt   int64      `json:"exp,omitempty"`
+}
+
+// IssueToken returns a token for the principal that is valid for ttl, or forever if ttl is zero
+func (a *HMACAuthenticator) IssueToken(principal Principal, ttl time.Duration) (string, error) {
+
+	if len(a.Secret) == 0 {
+		return "", ErrNoSecret
+	}
+
+	claims := hmacClaims{ClientID: principal.ClientID, Permissions: principal.Permissions}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sign(encoded)), nil
+}
+
+func (a *HMACAuthenticator) Authenticate(token string) (Principal, error) {
+
+	if len(a.Secret) == 0 {
+		return Principal{}, ErrNoSecret
+	}
+
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return Principal{}, errors.New("malformed token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, a.sign(encoded)) {
+		return Principal{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Principal{}, errors.New("malformed token")
+	}
+	var claims hmacClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Principal{}, errors.New("malformed token")
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return Principal{}, errors.New("token expired")
+	}
+
+	return Principal{ClientID: claims.ClientID, Permissions: claims.Permissions}, nil
+}
+
+func (a *HMACAuthenticator) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Authenticate authenticates the connection, for callers such as senders that do not register a client
+func (t *NotificationService) Authenticate(token string, reply *NotificationRegistration) error {
+
+	if err := t.session.login(token); err != nil {
+		return err
+	}
+	reply.ClientID = t.session.principalClientID()
+
+	return nil
+}
+
+// clientSession is what the server knows about the caller on one connection, or of one HTTP
+// request. A nil session belongs to a server without authentication or client certificates
+// and allows everything.
+type clientSession struct {
+	server       *NotificationServer
+	peerClientID string // the client named by the TLS certificate, if any
+
+	mu        sync.Mutex
+	principal *Principal // set once the caller has authenticated
+}
+
+// newSession returns the session for a caller, or nil if the server has nothing to check
+func (s *NotificationServer) newSession(peerClientID string) *clientSession {
+	if peerClientID == "" && s.Authenticator == nil {
+		return nil
+	}
+	return &clientSession{server: s, peerClientID: peerClientID}
+}
+
+// login authenticates the session with a token. An empty token leaves the session as it is.
+func (c *clientSession) login(token string) error {
+
+	if c == nil || c.server.Authenticator == nil || token == "" {
+		return nil
+	}
+
+	principal, err := c.server.Authenticator.Authenticate(token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	c.mu.Lock()
+	c.principal = &principal
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *clientSession) principalClientID() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.principal == nil {
+		return ""
+	}
+	return c.principal.ClientID
+}
+
+// allow checks that the caller holds the permission
+func (c *clientSession) allow(permission Permission) error {
+
+	if c == nil || c.server.Authenticator == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.principal == nil:
+		return ErrUnauthenticated
+	case !c.principal.Has(permission):
+		return ErrPermissionDenied
+	}
+
+	return nil
+}
+
+// clientID returns the ID a call on behalf of a client acts for. A caller bound to a client, by
+// its certificate or its principal, acts for that client only: an empty ID is taken as its own,
+// any other is refused. Only administrators may act for any client.
+func (c *clientSession) clientID(requested string) (string, error) {
+
+	if c == nil {
+		return requested, nil
+	}
+
+	if err := c.allow(PermissionListen); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	principal := c.principal
+	c.mu.Unlock()
+
+	if principal != nil && principal.Has(PermissionAdmin) {
+		return requested, nil
+	}
+
+	clientID, err := resolveClientID(c.peerClientID, requested)
+	if err != nil || principal == nil {
+		return clientID, err
+	}
+
+	if principal.ClientID == "" {
+		return "", fmt.Errorf("%w: the principal names no client", ErrPermissionDenied)
+	}
+	if clientID != "" && clientID != principal.ClientID {
+		return "", fmt.Errorf("%w: cannot act for client %s", ErrPermissionDenied, clientID)
+	}
+
+	return principal.ClientID, nil
+}
+
+// allowSend checks that the caller may send to the recipients of the request. Only a send to a
+// single client needs no more than PermissionSend, as a selector can match every client.
+func (c *clientSession) allowSend(send NotificationSend) error {
+	if send.ClientID == "" {
+		return c.allow(PermissionBroadcast)
+	}
+	return c.allow(PermissionSend)
+}
+
+func resolveClientID(peerClientID, requested string) (string, error) {
+	switch {
+	case peerClientID == "":
+		return requested, nil
+	case requested == "" || requested == peerClientID:
+		return peerClientID, nil
+	default:
+		return "", ErrClientIDMismatch
+	}
+}
+
+// clientID is clientSession.clientID for the session of the connection
+func (t *NotificationService) clientID(requested string) (string, error) {
+	return t.session.clientID(requested)
+}
+
+// authorizeClient authenticates the connection with the token of a registration and resolves
+// the client it acts for. The token is not kept with the registration.
+func (t *NotificationService) authorizeClient(client NotificationClient) (NotificationClient, error) {
+	return t.session.authorizeClient(client)
+}
+
+func (c *clientSession) authorizeClient(client NotificationClient) (NotificationClient, error) {
+
+	if err := c.login(client.Token); err != nil {
+		return client, err
+	}
+	client.Token = ""
+
+	clientID, err := c.clientID(client.ClientID)
+	client.ClientID = clientID
+
+	return client, err
+}
+
+// rpcServerFor returns the RPC server for a connection. A connection with a session gets a
+// service of its own, so that what the caller proves on one call holds for the next.
+func (s *NotificationServer) rpcServerFor(session *clientSession) *rpc.Server {
+
+	if session == nil {
+		return s.rpcServer
+	}
+
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(&NotificationService{server: s, session: session})
+
+	return rpcServer
+}
+
+type sessionKey struct{}
+
+// requestSession returns the session of an HTTP request, authenticated by its bearer token or
+// the access_token query parameter, for clients such as EventSource that cannot set headers
+func (s *NotificationServer) requestSession(req *http.Request) (*clientSession, error) {
+
+	session := s.newSession(s.peerClientID(req.TLS))
+
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = req.URL.Query().Get("access_token")
+	}
+
+	return session, session.login(token)
+}
+
+// withSession makes the session of the request available to sessionFromContext
+func (s *NotificationServer) withSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		session, err := s.requestSession(req)
+		if err != nil {
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+		handler(w, req.WithContext(context.WithValue(req.Context(), sessionKey{}, session)))
+	}
+}
+
+func sessionFromContext(ctx context.Context) *clientSession {
+	session, _ := ctx.Value(sessionKey{}).(*clientSession)
+	return session
+}
@@ -0,0 +1,52 @@
+package qsutils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticatorRoundTrip(t *testing.T) {
+
+	a := &HMACAuthenticator{Secret: []byte("secret")}
+
+	token, err := a.IssueToken(Principal{ClientID: "a", Permissions: PermissionListen}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal, err := a.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.ClientID != "a" || principal.Permissions != PermissionListen {
+		t.Fatalf("Authenticate returned %+v", principal)
+	}
+
+	other := &HMACAuthenticator{Secret: []byte("other")}
+	if _, err := other.Authenticate(token); err == nil {
+		t.Fatal("a token signed with another secret was accepted")
+	}
+}
+
+func TestHMACAuthenticatorWithoutSecret(t *testing.T) {
+
+	empty := &HMACAuthenticator{}
+
+	if _, err := empty.IssueToken(Principal{Permissions: PermissionAdmin}, 0); !errors.Is(err, ErrNoSecret) {
+		t.Fatalf("IssueToken returned %v, want ErrNoSecret", err)
+	}
+
+	// a token signed with an empty key, as anyone could make one
+	payload, err := json.Marshal(hmacClaims{Permissions: PermissionAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	forged := encoded + "." + base64.RawURLEncoding.EncodeToString(empty.sign(encoded))
+
+	if _, err := empty.Authenticate(forged); !errors.Is(err, ErrNoSecret) {
+		t.Fatalf("Authenticate returned %v, want ErrNoSecret", err)
+	}
+}
@@ -0,0 +1,176 @@
+package qsutils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrBacklogFull = errors.New("notification client backlog full")
+
+// OverflowPolicy decides what happens to a message sent to a client whose backlog is full
+type OverflowPolicy int
+
+const (
+	DropOldest       OverflowPolicy = iota // discard the oldest messages of the lowest priority until the new one fits
+	DropNewest                             // discard the new message
+	RejectWithError                        // discard the new message and return ErrBacklogFull to the sender
+	DisconnectClient                       // disconnect the client, discarding its backlog, and return ErrBacklogFull to the sender
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case RejectWithError:
+		return "reject"
+	case DisconnectClient:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// The backlog is kept in delivery order: highest priority first and in the order of arrival
+// within a priority. The list sorts ascending, so elements carry the negated message priority.
+
+// pushBacklog queues the message behind the backlog of the same priority
+func (c *notificationClientEntry) pushBacklog(message NotificationServiceMessage) {
+	c.backlog.InsertByPriority(message, -message.Priority)
+	c.backlogBytes += len(message.Message)
+}
+
+// pushBacklogFront queues a message that is being redelivered ahead of the backlog of the same priority
+func (c *notificationClientEntry) pushBacklogFront(message NotificationServiceMessage) {
+	c.backlog.InsertByPriorityFirst(message, -message.Priority)
+	c.backlogBytes += len(message.Message)
+}
+
+// dropOldestLowest discards the longest queued message of the lowest priority in the backlog
+func (c *notificationClientEntry) dropOldestLowest() (NotificationServiceMessage, bool) {
+	e := c.backlog.Back()
+	if e == nil {
+		return NotificationServiceMessage{}, false
+	}
+	for prev := e.Prev(); prev != nil && prev.Priority == e.Priority; prev = e.Prev() {
+		e = prev
+	}
+	return c.removeBacklogElement(e), true
+}
+
+// popBacklog removes and returns the next message to deliver
+func (c *notificationClientEntry) popBacklog() (NotificationServiceMessage, bool) {
+	e, ok := c.backlog.FrontPop()
+	if !ok {
+		return NotificationServiceMessage{}, false
+	}
+	message := e.Value.(NotificationServiceMessage)
+	c.backlogBytes -= len(message.Message)
+	return message, true
+}
+
+func (c *notificationClientEntry) removeBacklogElement(e *Element) NotificationServiceMessage {
+	message := c.backlog.Remove(e).(NotificationServiceMessage)
+	c.backlogBytes -= len(message.Message)
+	return message
+}
+
+func (c *notificationClientEntry) clearBacklog() {
+	c.backlog.Init()
+	c.backlogBytes = 0
+}
+
+// drainBacklog empties the backlog and returns its messages in delivery order
+func (c *notificationClientEntry) drainBacklog() []NotificationServiceMessage {
+	messages := make([]NotificationServiceMessage, 0, c.backlog.Len())
+	for message, ok := c.popBacklog(); ok; message, ok = c.popBacklog() {
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// nextBacklogLocked pops the next message that has not expired, discarding any that have
+func (s *NotificationServer) nextBacklogLocked(entry *notificationClientEntry) (NotificationServiceMessage, bool) {
+	now := time.Now()
+	for {
+		message, ok := entry.popBacklog()
+		if !ok {
+			return message, false
+		}
+		if !message.Expired(now) {
+			return message, true
+		}
+		s.metrics.countDroppedLocked(dropExpired, 1)
+		s.unpersistLocked(entry.info.ClientID, message.ID)
+	}
+}
+
+// purgeExpiredLocked discards the expired messages in the backlog of the client
+func (s *NotificationServer) purgeExpiredLocked(entry *notificationClientEntry) {
+	now := time.Now()
+	for e := entry.backlog.Front(); e != nil; {
+		next := e.Next()
+		if message := e.Value.(NotificationServiceMessage); message.Expired(now) {
+			entry.removeBacklogElement(e)
+			s.metrics.countDroppedLocked(dropExpired, 1)
+			s.unpersistLocked(entry.info.ClientID, message.ID)
+		}
+		e = next
+	}
+}
+
+// backlogFits reports whether the backlog stays within the limits with the extra message added
+func (s *NotificationServer) backlogFits(entry *notificationClientEntry, size int) bool {
+	if s.MaxBacklogMessages > 0 && entry.backlog.Len()+1 > s.MaxBacklogMessages {
+		return false
+	}
+	if s.MaxBacklogBytes > 0 && entry.backlogBytes+size > s.MaxBacklogBytes {
+		return false
+	}
+	return true
+}
+
+// makeRoomLocked applies the overflow policy before the message is queued for the client. It
+// returns false if the message should not be queued, with the error to give to the sender.
+func (s *NotificationServer) makeRoomLocked(entry *notificationClientEntry, message NotificationServiceMessage) (bool, error) {
+
+	size := len(message.Message)
+	if s.backlogFits(entry, size) {
+		return true, nil
+	}
+
+	s.purgeExpiredLocked(entry)
+	if s.backlogFits(entry, size) {
+		return true, nil
+	}
+
+	if s.MaxBacklogBytes > 0 && size > s.MaxBacklogBytes {
+		return false, fmt.Errorf("%w: message of %d bytes exceeds the limit of %d bytes", ErrBacklogFull, size, s.MaxBacklogBytes)
+	}
+
+	switch s.OverflowPolicy {
+	case DropNewest:
+		return false, nil
+
+	case RejectWithError:
+		return false, ErrBacklogFull
+
+	case DisconnectClient:
+		s.disconnectLocked(entry.info.ClientID)
+		return false, fmt.Errorf("%w: client %s disconnected", ErrBacklogFull, entry.info.ClientID)
+
+	default:
+		for !s.backlogFits(entry, size) {
+			dropped, ok := entry.dropOldestLowest()
+			if !ok {
+				break
+			}
+			s.metrics.countDroppedLocked(dropOverflow, 1)
+			s.publishLocked(ClientBacklogOverflow, entry, dropped)
+			s.unpersistLocked(entry.info.ClientID, dropped.ID)
+		}
+		return true, nil
+	}
+}
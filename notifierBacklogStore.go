@@ -0,0 +1,564 @@
+package qsutils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultCompactionInterval = time.Minute
+
+// BacklogStore persists the messages the notification server has accepted for each client but
+// not yet completed, so that they survive a restart. A message is appended when it is queued
+// for a client and removed once it has been delivered, or acknowledged by clients that
+// acknowledge messages.
+type BacklogStore interface {
+	Append(clientID string, message NotificationServiceMessage) error
+	Remove(clientID string, messageID uint64) error
+	Clear(clientID string) error
+
+	// Load returns the stored messages of every client in the order they were appended
+	Load() (map[string][]NotificationServiceMessage, error)
+	Close() error
+}
+
+// MessageIDStore is implemented by a BacklogStore that also keeps a high-water mark of the message
+// IDs issued by the server, so that a restarted server never issues an ID again, including those
+// of messages that were delivered without being stored
+type MessageIDStore interface {
+	// ReserveMessageIDs records that IDs up to and including upTo may have been issued
+	ReserveMessageIDs(upTo uint64) error
+	// ReservedMessageIDs returns the highest ID recorded
+	ReservedMessageIDs() (uint64, error)
+}
+
+// messageIDBlock is how many message IDs the server reserves at a time
+const messageIDBlock = 1024
+
+// backlogRecord is a single line of the write-ahead log of a FileBacklogStore
+type backlogRecord struct {
+	Op        string                      `json:"op"`
+	ClientID  string                      `json:"client"`
+	MessageID uint64                      `json:"id,omitempty"`
+	Message   *NotificationServiceMessage `json:"message,omitempty"`
+	Scheduled *ScheduledMessage           `json:"scheduled,omitempty"`
+}
+
+type storedMessage struct {
+	seq     uint64
+	message NotificationServiceMessage
+}
+
+// FileBacklogStore is a BacklogStore and ScheduleStore kept in an append-only log file. Every
+// change is written as a JSON line; the log is periodically compacted by rewriting it with only
+// the live messages.
+type FileBacklogStore struct {
+	// SyncWrites makes every change fsync the log before returning
+	SyncWrites bool
+
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	live     map[string]map[uint64]storedMessage
+	schedule map[uint64]ScheduledMessage
+	reserved uint64 // high-water mark of the message IDs, see MessageIDStore
+	seq      uint64
+	records  int // records in the log, compared with the live messages to decide on compaction
+	stopChan chan struct{}
+	closed   bool
+}
+
+var _ BacklogStore = new(FileBacklogStore)
+var _ ScheduleStore = new(FileBacklogStore)
+var _ MessageIDStore = new(FileBacklogStore)
+
+// OpenFileBacklogStore opens or creates the log at path, replays it and compacts it every
+// compactionInterval. A compactionInterval of zero uses the default of one minute.
+func OpenFileBacklogStore(path string, compactionInterval time.Duration) (*FileBacklogStore, error) {
+
+	if compactionInterval <= 0 {
+		compactionInterval = defaultCompactionInterval
+	}
+
+	st := &FileBacklogStore{
+		path:     path,
+		live:     make(map[string]map[uint64]storedMessage),
+		schedule: make(map[uint64]ScheduledMessage),
+		stopChan: make(chan struct{}),
+	}
+
+	if err := st.replay(); err != nil {
+		return nil, err
+	}
+
+	// start from a compacted log, which also drops a torn record at the end of the old one
+	st.mu.Lock()
+	err := st.compactLocked()
+	st.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go st.compactPeriodically(compactionInterval)
+
+	return st, nil
+}
+
+func (st *FileBacklogStore) Append(clientID string, message NotificationServiceMessage) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.writeLocked(backlogRecord{Op: "append", ClientID: clientID, Message: &message}); err != nil {
+		return err
+	}
+	st.applyLocked(backlogRecord{Op: "append", ClientID: clientID, Message: &message})
+
+	return nil
+}
+
+func (st *FileBacklogStore) Remove(clientID string, messageID uint64) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.live[clientID][messageID]; !ok {
+		return nil
+	}
+
+	record := backlogRecord{Op: "remove", ClientID: clientID, MessageID: messageID}
+	if err := st.writeLocked(record); err != nil {
+		return err
+	}
+	st.applyLocked(record)
+
+	return nil
+}
+
+func (st *FileBacklogStore) Clear(clientID string) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.live[clientID]; !ok {
+		return nil
+	}
+
+	record := backlogRecord{Op: "clear", ClientID: clientID}
+	if err := st.writeLocked(record); err != nil {
+		return err
+	}
+	st.applyLocked(record)
+
+	return nil
+}
+
+func (st *FileBacklogStore) Load() (map[string][]NotificationServiceMessage, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	backlogs := make(map[string][]NotificationServiceMessage, len(st.live))
+	for clientID, messages := range st.live {
+		backlogs[clientID] = orderedStoredMessages(messages)
+	}
+
+	return backlogs, nil
+}
+
+func (st *FileBacklogStore) AppendScheduled(scheduled ScheduledMessage) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	record := backlogRecord{Op: "schedule", Scheduled: &scheduled}
+	if err := st.writeLocked(record); err != nil {
+		return err
+	}
+	st.applyLocked(record)
+
+	return nil
+}
+
+func (st *FileBacklogStore) RemoveScheduled(messageID uint64) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.schedule[messageID]; !ok {
+		return nil
+	}
+
+	record := backlogRecord{Op: "unschedule", MessageID: messageID}
+	if err := st.writeLocked(record); err != nil {
+		return err
+	}
+	st.applyLocked(record)
+
+	return nil
+}
+
+func (st *FileBacklogStore) LoadScheduled() ([]ScheduledMessage, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.scheduledInOrderLocked(), nil
+}
+
+func (st *FileBacklogStore) ReserveMessageIDs(upTo uint64) error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if upTo <= st.reserved {
+		return nil
+	}
+
+	record := backlogRecord{Op: "reserve", MessageID: upTo}
+	if err := st.writeLocked(record); err != nil {
+		return err
+	}
+	st.applyLocked(record)
+
+	return nil
+}
+
+func (st *FileBacklogStore) ReservedMessageIDs() (uint64, error) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.reserved, nil
+}
+
+func (st *FileBacklogStore) scheduledInOrderLocked() []ScheduledMessage {
+	scheduled := make([]ScheduledMessage, 0, len(st.schedule))
+	for _, sm := range st.schedule {
+		scheduled = append(scheduled, sm)
+	}
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Message.ID < scheduled[j].Message.ID })
+	return scheduled
+}
+
+// Close compacts the log and closes it
+func (st *FileBacklogStore) Close() error {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return nil
+	}
+	err := st.compactLocked()
+	st.closed = true
+	close(st.stopChan)
+
+	return errors.Join(err, st.file.Close())
+}
+
+func (st *FileBacklogStore) writeLocked(record backlogRecord) error {
+
+	if st.closed {
+		return errors.New("backlog store closed")
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := st.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	st.records++
+
+	if st.SyncWrites {
+		return st.file.Sync()
+	}
+	return nil
+}
+
+func (st *FileBacklogStore) applyLocked(record backlogRecord) {
+	switch record.Op {
+	case "append":
+		if record.Message == nil {
+			return
+		}
+		if _, ok := st.live[record.ClientID]; !ok {
+			st.live[record.ClientID] = make(map[uint64]storedMessage)
+		}
+		// a message stored again keeps its place
+		stored, ok := st.live[record.ClientID][record.Message.ID]
+		if !ok {
+			st.seq++
+			stored.seq = st.seq
+		}
+		stored.message = *record.Message
+		st.live[record.ClientID][record.Message.ID] = stored
+	case "remove":
+		delete(st.live[record.ClientID], record.MessageID)
+		if len(st.live[record.ClientID]) == 0 {
+			delete(st.live, record.ClientID)
+		}
+	case "clear":
+		delete(st.live, record.ClientID)
+	case "schedule":
+		if record.Scheduled != nil {
+			st.schedule[record.Scheduled.Message.ID] = *record.Scheduled
+		}
+	case "unschedule":
+		delete(st.schedule, record.MessageID)
+	case "reserve":
+		st.reserved = max(st.reserved, record.MessageID)
+	}
+}
+
+// replay rebuilds the live messages from the log. A record that cannot be decoded ends the
+// replay, since it can only be the result of a write interrupted by a crash.
+func (st *FileBacklogStore) replay() error {
+
+	f, err := os.Open(st.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record backlogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("backlog store %s: ignoring log from damaged record: %v", st.path, err)
+			break
+		}
+		st.applyLocked(record)
+	}
+
+	return scanner.Err()
+}
+
+// compactLocked rewrites the log with only the live messages and switches to appending to it
+func (st *FileBacklogStore) compactLocked() error {
+
+	tmpPath := st.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	records := 0
+
+	if st.reserved > 0 {
+		line, err := json.Marshal(backlogRecord{Op: "reserve", MessageID: st.reserved})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+		records++
+	}
+	clientIDs := make([]string, 0, len(st.live))
+	for clientID := range st.live {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+
+	// messages are written in the order they were appended, so a replay restores that order
+	for _, clientID := range clientIDs {
+		stored := st.live[clientID]
+		for _, message := range orderedStoredMessages(stored) {
+			message := message
+			line, err := json.Marshal(backlogRecord{Op: "append", ClientID: clientID, Message: &message})
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			w.Write(append(line, '\n'))
+			records++
+		}
+	}
+
+	for _, scheduled := range st.scheduledInOrderLocked() {
+		scheduled := scheduled
+		line, err := json.Marshal(backlogRecord{Op: "schedule", Scheduled: &scheduled})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+		records++
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, st.path); err != nil {
+		return err
+	}
+
+	if st.file != nil {
+		st.file.Close()
+	}
+	st.file, err = os.OpenFile(st.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	st.records = records
+
+	return nil
+}
+
+func (st *FileBacklogStore) compactPeriodically(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.stopChan:
+			return
+		case <-ticker.C:
+			st.mu.Lock()
+			liveCount := len(st.schedule)
+			for _, messages := range st.live {
+				liveCount += len(messages)
+			}
+			if !st.closed && st.records > liveCount {
+				if err := st.compactLocked(); err != nil {
+					log.Printf("backlog store %s: compaction failed: %v", st.path, err)
+				}
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+func orderedStoredMessages(stored map[uint64]storedMessage) []NotificationServiceMessage {
+	ordered := make([]storedMessage, 0, len(stored))
+	for _, s := range stored {
+		ordered = append(ordered, s)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].seq < ordered[j].seq })
+
+	messages := make([]NotificationServiceMessage, len(ordered))
+	for i, s := range ordered {
+		messages[i] = s.message
+	}
+	return messages
+}
+
+// loadBacklogLocked restores the stored backlogs into the registry. The clients get them when they poll again.
+func (s *NotificationServer) loadBacklogLocked() error {
+
+	backlogs, err := s.BacklogStore.Load()
+	if err != nil {
+		return err
+	}
+
+	for clientID, messages := range backlogs {
+		entry := s.clientEntryLocked(clientID)
+		for _, message := range messages {
+			entry.pushBacklog(message)
+			s.lastMessageID = max(s.lastMessageID, message.ID)
+		}
+	}
+
+	return nil
+}
+
+// loadMessageIDLocked continues the message IDs after the highest one a MessageIDStore recorded
+func (s *NotificationServer) loadMessageIDLocked() error {
+
+	store, ok := s.BacklogStore.(MessageIDStore)
+	if !ok {
+		return nil
+	}
+
+	reserved, err := store.ReservedMessageIDs()
+	if err != nil {
+		return err
+	}
+	s.lastMessageID = max(s.lastMessageID, reserved)
+	s.reservedID = max(s.reservedID, reserved)
+
+	return nil
+}
+
+// reserveMessageIDsLocked records the next block of message IDs before any of them is issued
+func (s *NotificationServer) reserveMessageIDsLocked() {
+
+	store, ok := s.BacklogStore.(MessageIDStore)
+	if !ok {
+		return
+	}
+
+	upTo := s.lastMessageID + messageIDBlock - 1
+	if err := store.ReserveMessageIDs(upTo); err != nil {
+		log.Printf("backlog store: cannot reserve message IDs up to %d: %v", upTo, err)
+		return
+	}
+	s.reservedID = upTo
+}
+
+func (s *NotificationServer) persistLocked(clientID string, message NotificationServiceMessage) error {
+	if s.BacklogStore == nil || message.ID == 0 {
+		return nil
+	}
+	return s.BacklogStore.Append(clientID, message)
+}
+
+// repersistBacklogLocked stores the backlog of the client again in its current order, after a
+// message that had already left the store went back to the front of the backlog
+func (s *NotificationServer) repersistBacklogLocked(entry *notificationClientEntry) error {
+
+	if s.BacklogStore == nil {
+		return nil
+	}
+
+	clientID := entry.info.ClientID
+	if err := s.BacklogStore.Clear(clientID); err != nil {
+		return err
+	}
+	for e := entry.backlog.Front(); e != nil; e = e.Next() {
+		if err := s.persistLocked(clientID, e.Value.(NotificationServiceMessage)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NotificationServer) unpersistLocked(clientID string, messageID uint64) {
+	if s.BacklogStore == nil || messageID == 0 {
+		return
+	}
+	if err := s.BacklogStore.Remove(clientID, messageID); err != nil {
+		log.Printf("backlog store: cannot remove message %d of client %s: %v", messageID, clientID, err)
+	}
+}
+
+func (s *NotificationServer) clearPersistedLocked(clientID string) {
+	if s.BacklogStore == nil {
+		return
+	}
+	if err := s.BacklogStore.Clear(clientID); err != nil {
+		log.Printf("backlog store: cannot clear backlog of client %s: %v", clientID, err)
+	}
+}
@@ -0,0 +1,132 @@
+package qsutils
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T, path string) *FileBacklogStore {
+	t.Helper()
+	store, err := OpenFileBacklogStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func loadedServer(t *testing.T, store BacklogStore) *NotificationServer {
+	t.Helper()
+	s := NewNotificationServer(nil)
+	s.BacklogStore = store
+	s.mu.Lock()
+	err := s.loadStoreLocked()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func storedIDs(t *testing.T, store BacklogStore, clientID string) []uint64 {
+	t.Helper()
+	backlogs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	for _, message := range backlogs[clientID] {
+		ids = append(ids, message.ID)
+	}
+	return ids
+}
+
+func TestMessageIDsNotReusedAfterRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "backlog")
+
+	store := openTestStore(t, path)
+	s := loadedServer(t, store)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+	delivered := s.listen(NotificationClient{ClientID: "a"})
+	if delivered.ID == 0 {
+		t.Fatalf("listen returned %v, want the queued message", delivered)
+	}
+	s.Shutdown(context.Background())
+	store.Close()
+
+	// the delivered message has been compacted away, only the reservation remains
+	store = openTestStore(t, path)
+	defer store.Close()
+	if ids := storedIDs(t, store, "a"); len(ids) != 0 {
+		t.Fatalf("store still holds %v", ids)
+	}
+
+	s = loadedServer(t, store)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+	backlog, err := s.Backlog("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].ID <= delivered.ID {
+		t.Fatalf("message after restart has ID %d, want above %d", backlog[0].ID, delivered.ID)
+	}
+}
+
+func TestFileBacklogStoreAppendKeepsPlace(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "backlog")
+
+	store := openTestStore(t, path)
+	for _, id := range []uint64{1, 2, 1} {
+		if err := store.Append("a", NotificationServiceMessage{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := storedIDs(t, store, "a"); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("stored order is %v, want [1 2]", ids)
+	}
+	store.Close()
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	if ids := storedIDs(t, store, "a"); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("replayed order is %v, want [1 2]", ids)
+	}
+}
+
+func TestAbandonedMessageKeepsStoredOrder(t *testing.T) {
+
+	store := openTestStore(t, filepath.Join(t.TempDir(), "backlog"))
+	defer store.Close()
+	s := loadedServer(t, store)
+
+	// a poll that is withdrawn after the first message was handed to it
+	listenerChan := make(chan NotificationServiceMessage, 1)
+	s.registerListener(listenerChan, NotificationClient{ClientID: "a"}, false)
+	for i := 0; i < 2; i++ {
+		if err := s.SendMessageToClient("a", NotificationServiceMessage{MessageType: MESSAGE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.abandonListener("a", listenerChan)
+
+	backlog, err := s.Backlog("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := storedIDs(t, store, "a")
+	if len(backlog) != 2 || len(ids) != 2 || ids[0] != backlog[0].ID || ids[1] != backlog[1].ID {
+		t.Fatalf("stored order %v differs from the backlog %v", ids, backlog)
+	}
+}
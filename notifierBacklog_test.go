@@ -0,0 +1,122 @@
+package qsutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func backlogBodies(t *testing.T, s *NotificationServer, clientID string) []string {
+	t.Helper()
+	backlog, err := s.Backlog(clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, message := range backlog {
+		bodies = append(bodies, getStringFromGob(message.Message))
+	}
+	return bodies
+}
+
+func TestBacklogOverflowPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy  OverflowPolicy
+		wantErr bool
+		backlog []string // nil if the client is expected to be gone
+	}{
+		{DropOldest, false, []string{"2", "3"}},
+		{DropNewest, false, []string{"1", "2"}},
+		{RejectWithError, true, []string{"1", "2"}},
+		{DisconnectClient, true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+
+			s := NewNotificationServer(nil)
+			s.MaxBacklogMessages = 2
+			s.OverflowPolicy = test.policy
+			if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			for _, body := range []string{"1", "2", "3"} {
+				err = s.SendMessageToClient("a", NotificationServiceMessage{Message: getGobFromString(body), MessageType: MESSAGE})
+			}
+			if test.wantErr != errors.Is(err, ErrBacklogFull) {
+				t.Fatalf("the overflowing send returned %v", err)
+			}
+
+			if test.backlog == nil {
+				if _, err := s.Client("a"); !errors.Is(err, ErrUnknownClient) {
+					t.Fatalf("Client returned %v, want ErrUnknownClient", err)
+				}
+				return
+			}
+			bodies := backlogBodies(t, s, "a")
+			if len(bodies) != len(test.backlog) || bodies[0] != test.backlog[0] || bodies[1] != test.backlog[1] {
+				t.Fatalf("backlog is %v, want %v", bodies, test.backlog)
+			}
+		})
+	}
+}
+
+func TestBacklogMessageLargerThanMaxBytes(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.MaxBacklogBytes = 10
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{Message: make([]byte, 11), MessageType: MESSAGE}); !errors.Is(err, ErrBacklogFull) {
+		t.Fatalf("SendMessageToClient returned %v, want ErrBacklogFull", err)
+	}
+}
+
+func TestExpiredMessagesNotDelivered(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiring := NotificationServiceMessage{Message: getGobFromString("expiring"), MessageType: MESSAGE}.WithTTL(10 * time.Millisecond)
+	kept := NotificationServiceMessage{Message: getGobFromString("kept"), MessageType: MESSAGE}
+	for _, message := range []NotificationServiceMessage{expiring, kept} {
+		if err := s.SendMessageToClient("a", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if message := s.listen(NotificationClient{ClientID: "a"}); getStringFromGob(message.Message) != "kept" {
+		t.Fatalf("listen returned %q, want the unexpired message", getStringFromGob(message.Message))
+	}
+}
+
+func TestExpiredMessagesMakeRoom(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.MaxBacklogMessages = 1
+	s.OverflowPolicy = RejectWithError
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expiring := NotificationServiceMessage{Message: getGobFromString("expiring"), MessageType: MESSAGE}.WithTTL(10 * time.Millisecond)
+	if err := s.SendMessageToClient("a", expiring); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{Message: getGobFromString("kept"), MessageType: MESSAGE}); err != nil {
+		t.Fatalf("the expired message still takes up the backlog: %v", err)
+	}
+	if bodies := backlogBodies(t, s, "a"); len(bodies) != 1 || bodies[0] != "kept" {
+		t.Fatalf("backlog is %v, want [kept]", bodies)
+	}
+}
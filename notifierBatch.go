@@ -0,0 +1,85 @@
+package qsutils
+
+// ListenBatch is like Listen, but once a message is available the reply also carries as much
+// of the backlog as fits in the limits of the request, so a client catches up in a few calls.
+func (t *NotificationService) ListenBatch(request NotificationBatchRequest, reply *NotificationServiceBatch) error {
+
+	if t.server.disabled.Load() {
+		reply.Messages = []NotificationServiceMessage{t.controlReply(NotificationServiceMessage{Message: getGobFromString("Disabled"), MessageType: DISABLED})}
+		return nil
+	}
+
+	client, err := t.authorizeClient(request.Client)
+	if err != nil {
+		return err
+	}
+	request.Client = client
+
+	*reply = t.server.listenBatch(request)
+	reply.Messages[0] = t.controlReply(reply.Messages[0])
+
+	return nil
+}
+
+func (s *NotificationServer) listenBatch(request NotificationBatchRequest) NotificationServiceBatch {
+
+	maxMessages, maxBytes := s.batchLimits(request)
+
+	first := s.listen(request.Client)
+	batch := NotificationServiceBatch{ClientID: first.ClientID, Messages: []NotificationServiceMessage{first}}
+
+	// control messages such as REFRESHTIMER or DISCONNECTED are never batched
+	if first.ID == 0 {
+		return batch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[first.ClientID]
+	if !ok {
+		return batch
+	}
+
+	// the client may have been paused while the first message was on its way
+	size := len(first.Message)
+	for len(batch.Messages) < maxMessages && !entry.paused {
+		message, ok := s.nextBacklogLocked(entry)
+		if !ok {
+			break
+		}
+		if size+len(message.Message) > maxBytes {
+			entry.pushBacklogFront(message)
+			break
+		}
+		if !entry.info.Acknowledge {
+			s.unpersistLocked(entry.info.ClientID, message.ID)
+		}
+		message = s.markDeliveredLocked(entry, message)
+		message.ClientID = first.ClientID
+		batch.Messages = append(batch.Messages, message)
+		size += len(message.Message)
+	}
+
+	return batch
+}
+
+// batchLimits lowers the limits asked for by the client to the maximums of the server
+func (s *NotificationServer) batchLimits(request NotificationBatchRequest) (int, int) {
+
+	maxMessages, maxBytes := s.MaxBatchMessages, s.MaxBatchBytes
+	if request.MaxMessages > 0 && (maxMessages <= 0 || request.MaxMessages < maxMessages) {
+		maxMessages = request.MaxMessages
+	}
+	if request.MaxBytes > 0 && (maxBytes <= 0 || request.MaxBytes < maxBytes) {
+		maxBytes = request.MaxBytes
+	}
+	if maxMessages <= 0 {
+		maxMessages = defaultMaxBatchMessages
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBatchBytes
+	}
+
+	return maxMessages, maxBytes
+}
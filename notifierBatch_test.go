@@ -0,0 +1,66 @@
+package qsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListenBatchLimits(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.SendMessageToClient("a", NotificationServiceMessage{Message: make([]byte, 10), MessageType: MESSAGE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := s.listenBatch(NotificationBatchRequest{Client: NotificationClient{ClientID: "a"}, MaxMessages: 3})
+	if len(batch.Messages) != 3 {
+		t.Fatalf("batch holds %d messages, want MaxMessages 3", len(batch.Messages))
+	}
+
+	batch = s.listenBatch(NotificationBatchRequest{Client: NotificationClient{ClientID: "a"}, MaxBytes: 15})
+	if len(batch.Messages) != 1 {
+		t.Fatalf("batch holds %d messages, want 1 within MaxBytes 15", len(batch.Messages))
+	}
+}
+
+func TestListenBatchSkipsExpiredWithinMaxBytes(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NotificationServiceMessage{Message: make([]byte, 10), MessageType: MESSAGE}
+	expiring := NotificationServiceMessage{Message: make([]byte, 10), MessageType: MESSAGE, ExpiresAt: time.Now().Add(20 * time.Millisecond)}
+	large := NotificationServiceMessage{Message: make([]byte, 100), MessageType: MESSAGE}
+	for _, message := range []NotificationServiceMessage{first, expiring, large} {
+		if err := s.SendMessageToClient("a", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the expired message would fit, the one behind it does not
+	batch := s.listenBatch(NotificationBatchRequest{Client: NotificationClient{ClientID: "a"}, MaxBytes: 50})
+
+	size := 0
+	for _, message := range batch.Messages {
+		size += len(message.Message)
+	}
+	if len(batch.Messages) != 1 || size > 50 {
+		t.Fatalf("batch holds %d messages of %d bytes, want 1 within MaxBytes 50", len(batch.Messages), size)
+	}
+
+	backlog, err := s.Backlog("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || len(backlog[0].Message) != 100 {
+		t.Fatalf("backlog is %v, want the large message kept for the next poll", backlog)
+	}
+}
@@ -1,20 +1,24 @@
 package qsutils
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/rpc"
 	"os"
-	"time"
 )
 
+// Listen makes a single poll on a new connection to the server.
+//
+// Deprecated: Listen exits the process if the server cannot be reached. Use NotificationListener.
 func Listen(protocol, address string) (reply *NotificationServiceMessage) {
 	client, err := rpc.DialHTTP(protocol, address)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
 	var clientProcessID int = os.Getpid()
-	notificationClient := NotificationClient{ProcessID: clientProcessID}
+	hostname, _ := os.Hostname()
+	notificationClient := NotificationClient{ClientID: fmt.Sprintf("%s:%d", hostname, clientProcessID), ProcessID: clientProcessID}
 
 	// Asynchronous call
 	reply = new(NotificationServiceMessage)
@@ -23,28 +27,31 @@ func Listen(protocol, address string) (reply *NotificationServiceMessage) {
 	return
 }
 
-// Example of how to use the Listen function
+// Example of how to use the NotificationRouter
 func ListenExample(protocol, address string) {
 
-	for {
-
-		reply := Listen(protocol, address)
-
-		switch reply.MessageType {
-		case MESSAGE:
-			fmt.Println("Message received: ", getStringFromGob(reply.Message))
-		case TIMEOUT:
-			fmt.Println("Timeout received: ", getStringFromGob(reply.Message))
-		case BROADCASTMESSAGE:
-			fmt.Println("Broadcast message received received: ", getStringFromGob(reply.Message))
-		case DISABLED:
-			fmt.Println("Server currently disabled. Will try again in 10 seconds")
-			time.Sleep(10 * time.Second)
-		case REFRESHTIMER:
-			fmt.Println("Refresh timer received: ", getStringFromGob(reply.Message))
-
-		default:
-			fmt.Println("Notification received: ", getStringFromGob(reply.Message))
+	listener := NewNotificationListener(protocol, address)
+	listener.OnStateChange = func(state ConnectionState, err error) {
+		fmt.Println("Connection state changed: ", state, err)
+	}
+	defer listener.Close()
+
+	router := NewNotificationRouter(listener)
+	router.Use(RecoveryMiddleware(), DecodingMiddleware(nil))
+
+	printer := func(label string) NotificationHandlerFunc {
+		return func(ctx context.Context, message NotificationServiceMessage) error {
+			fmt.Println(label, DecodedPayload(ctx))
+			return nil
 		}
 	}
+
+	router.Handle(MESSAGE, printer("Message received: "))
+	router.Handle(TIMEOUT, printer("Timeout received: "))
+	router.Handle(BROADCASTMESSAGE, printer("Broadcast message received received: "))
+	router.Handle(REFRESHTIMER, printer("Refresh timer received: "))
+	router.Default(printer("Notification received: "))
+
+	err := router.Run(context.Background())
+	fmt.Println("Listener stopped: ", err)
 }
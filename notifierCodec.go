@@ -0,0 +1,198 @@
+package qsutils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Content types of the built in codecs. A message with an empty ContentType is gob encoded, as
+// every message was before content types were introduced.
+const (
+	ContentTypeGob  = "application/x-gob"
+	ContentTypeJSON = "application/json"
+	ContentTypeRaw  = "application/octet-stream"
+	ContentTypeText = "text/plain; charset=utf-8"
+)
+
+// Codec encodes message bodies. The content type it declares is stored in the message, so that
+// the receiver can find the same codec with CodecFor.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// GobCodec encodes values with encoding/gob
+	GobCodec Codec = gobCodec{}
+
+	// JSONCodec encodes values with encoding/json, for receivers that are not written in Go
+	JSONCodec Codec = jsonCodec{}
+
+	// RawCodec passes []byte and string values through as they are
+	RawCodec Codec = rawCodec{}
+
+	// TextCodec carries UTF-8 text, as in the control messages of the JSON transports
+	TextCodec Codec = textCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byContentType map[string]Codec
+}{
+	byContentType: map[string]Codec{
+		ContentTypeGob:  GobCodec,
+		ContentTypeJSON: JSONCodec,
+		ContentTypeRaw:  RawCodec,
+		ContentTypeText: TextCodec,
+	},
+}
+
+// RegisterCodec makes the codec available to CodecFor and Decode, replacing any codec registered for the same content type
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byContentType[codec.ContentType()] = codec
+}
+
+// CodecFor returns the codec registered for the content type. An empty content type is gob.
+func CodecFor(contentType string) (Codec, bool) {
+
+	if contentType == "" {
+		return GobCodec, true
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.byContentType[contentType]
+
+	return codec, ok
+}
+
+// Encode returns a MESSAGE carrying v encoded with the codec, with its ContentType set. A nil codec is gob.
+func Encode[T any](codec Codec, v T) (NotificationServiceMessage, error) {
+
+	if codec == nil {
+		codec = GobCodec
+	}
+
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return NotificationServiceMessage{}, err
+	}
+
+	return NotificationServiceMessage{Message: data, MessageType: MESSAGE, ContentType: codec.ContentType()}, nil
+}
+
+// Decode decodes the body of the message into a T with the codec named by its ContentType
+func Decode[T any](message NotificationServiceMessage) (T, error) {
+
+	var v T
+
+	codec, ok := CodecFor(message.ContentType)
+	if !ok {
+		return v, fmt.Errorf("no codec for content type %q", message.ContentType)
+	}
+	err := codec.Unmarshal(message.Message, &v)
+
+	return v, err
+}
+
+// textControlMessage builds a control message with a plain text body, for the JSON transports
+func textControlMessage(text string, messageType int, clientID string) NotificationServiceMessage {
+	return NotificationServiceMessage{Message: []byte(text), MessageType: messageType, ClientID: clientID, ContentType: ContentTypeText}
+}
+
+// textControl rewrites the gob string body of a control message generated by the server, one
+// without an ID, as plain text for the JSON transports. Other messages are returned as they are.
+func textControl(message NotificationServiceMessage) NotificationServiceMessage {
+	if message.ID != 0 || message.ContentType != "" {
+		return message
+	}
+	message.Message = []byte(getStringFromGob(message.Message))
+	message.ContentType = ContentTypeText
+	return message
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type rawCodec struct{}
+
+func (rawCodec) ContentType() string { return ContentTypeRaw }
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("raw codec cannot encode %T", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+	case *string:
+		*v = string(data)
+	case *any:
+		*v = append([]byte(nil), data...)
+	default:
+		return fmt.Errorf("raw codec cannot decode into %T", v)
+	}
+	return nil
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string { return ContentTypeText }
+
+func (textCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("text codec cannot encode %T", v)
+	}
+}
+
+func (textCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+	case *any:
+		*v = string(data)
+	default:
+		return fmt.Errorf("text codec cannot decode into %T", v)
+	}
+	return nil
+}
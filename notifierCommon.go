@@ -3,16 +3,160 @@ package qsutils
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"strconv"
+	"time"
 )
 
 type NotificationServiceMessage struct {
-	Message     []byte
-	MessageType int
+	Message         []byte
+	MessageType     int
+	ClientID        string // the ID the server knows the receiving client by
+	Topic           string // the topic the message was published to, empty if it was addressed directly
+	ID              uint64 // assigned by the server to every message passed to a send API, zero for control messages
+	DeliveryAttempt int    // 1 on first delivery, higher when the message is redelivered
+
+	// ExpiresAt, if set, is the time after which the message is discarded instead of delivered
+	ExpiresAt time.Time
+
+	// Priority orders the backlog of a client: higher priorities are delivered first, equal
+	// priorities in the order they were sent. The default is 0.
+	Priority int
+
+	// ContentType names the codec the body was encoded with, see CodecFor. Empty means gob.
+	ContentType string
 }
 
+// WithTTL returns a copy of the message that expires after d
+func (m NotificationServiceMessage) WithTTL(d time.Duration) NotificationServiceMessage {
+	m.ExpiresAt = time.Now().Add(d)
+	return m
+}
+
+// Expired reports whether the message has an expiry time that has passed
+func (m NotificationServiceMessage) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// NotificationClient identifies a client to the server. ClientID is the identity that every
+// server API is keyed by; if it is empty the server issues one. ProcessID is informational only.
 type NotificationClient struct {
+	ClientID   string
 	ProcessID  int
 	Properties map[string]any
+	Topics     []string // topics to subscribe to, added to any existing subscriptions
+
+	// Acknowledge tells the server that the client calls NotificationService.Ack for every message
+	// it has processed. Unacknowledged messages are then redelivered on the next poll or after the ack timeout.
+	Acknowledge bool
+
+	// Token authenticates the client to a server with an Authenticator. It is not kept by the server.
+	Token string
+
+	// HeartbeatInterval asks the server to expire the client if it is not heard from for a few
+	// intervals. Zero takes the default of the server. The server may lower it.
+	HeartbeatInterval time.Duration
+
+	// PollTimeout asks the server to answer a poll that no message arrives for with TIMEOUT after
+	// this long, for clients behind proxies that close idle connections. The server enforces its
+	// MaxPollTimeout. Zero leaves it to the refresh timer of the server, which answers REFRESHTIMER.
+	// In JSON it is a number of nanoseconds.
+	PollTimeout time.Duration
+}
+
+// NotificationBatchRequest is the argument of NotificationService.ListenBatch. The limits are
+// lowered to the maximums of the server, zero asks for the server maximum.
+type NotificationBatchRequest struct {
+	Client      NotificationClient
+	MaxMessages int
+	MaxBytes    int
+}
+
+// NotificationServiceBatch is the reply to NotificationService.ListenBatch
+type NotificationServiceBatch struct {
+	ClientID string
+	Messages []NotificationServiceMessage
+}
+
+// NotificationSend is the argument of NotificationService.Send. Exactly one of ClientID, Topic,
+// Selector and Broadcast picks the recipients. The body is Message, or Payload if it is set, so
+// that JSON clients can send a JSON value as it is instead of base64; ContentType defaults to
+// ContentTypeJSON for a Payload. A zero MessageType sends a MESSAGE, or a BROADCASTMESSAGE for
+// Broadcast.
+type NotificationSend struct {
+	ClientID  string
+	Topic     string
+	Selector  string
+	Broadcast bool
+
+	MessageType int
+	Message     []byte
+	Payload     json.RawMessage
+	ContentType string
+	Priority    int
+	ExpiresAt   time.Time
+}
+
+// NotificationAck is the argument of NotificationService.Ack
+type NotificationAck struct {
+	ClientID   string
+	MessageIDs []uint64
+}
+
+// NotificationSubscription is the request and reply of NotificationService.Subscribe and Unsubscribe.
+// The reply holds every topic the client is subscribed to.
+type NotificationSubscription struct {
+	ClientID string
+	Topics   []string
+}
+
+// NotificationRegistration is the reply to NotificationService.Register. The client is expected
+// to be heard from every HeartbeatInterval, if it is not zero, and the server answers every poll
+// within PollTimeout with TIMEOUT, or within RefreshInterval with REFRESHTIMER if PollTimeout is zero.
+type NotificationRegistration struct {
+	ClientID          string
+	HeartbeatInterval time.Duration
+	RefreshInterval   time.Duration
+	PollTimeout       time.Duration
+}
+
+// PollState tells whether a client has a poll waiting on the server
+type PollState string
+
+const (
+	PollIdle    PollState = "idle"    // the client is between polls
+	PollWaiting PollState = "waiting" // a poll of the client is held until a message arrives
+	PollExpired PollState = "expired" // the client missed its heartbeats, its backlog is kept until it returns
+)
+
+// NotificationClientInfo is what the server knows about a registered client, as reported by
+// NotificationServer.Clients and the admin API
+type NotificationClientInfo struct {
+	ClientID          string
+	ProcessID         int
+	Properties        map[string]any
+	Topics            []string
+	Acknowledge       bool
+	LastSeen          time.Time // the last poll, registration, acknowledgement or heartbeat of the client
+	HeartbeatInterval time.Duration
+	PollState         PollState
+	BacklogMessages   int
+	BacklogBytes      int
+	InflightMessages  int  // delivered and waiting for an acknowledgement
+	Paused            bool // see NotificationServer.PauseClient
+}
+
+// NotificationPauseRequest is the argument of NotificationService.Pause and Resume: either a
+// single client or every client matching a selector
+type NotificationPauseRequest struct {
+	ClientID string
+	Selector string
+}
+
+// NotificationClientQuery is the argument of NotificationService.Clients. An empty Selector
+// matches every client.
+type NotificationClientQuery struct {
+	Selector string
 }
 
 const (
@@ -25,8 +169,37 @@ const (
 	OPERATIONALMESSAGE = iota
 	TIMEOUT            = iota
 	REFRESHTIMER       = iota
+	PAUSED             = iota
 )
 
+// MessageTypeName returns a readable name for the message type, or its number for custom types
+func MessageTypeName(messageType int) string {
+	switch messageType {
+	case REGISTERED:
+		return "REGISTERED"
+	case DISABLED:
+		return "DISABLED"
+	case MESSAGE:
+		return "MESSAGE"
+	case DISCONNECTED:
+		return "DISCONNECTED"
+	case CLEARBACKLOG:
+		return "CLEARBACKLOG"
+	case BROADCASTMESSAGE:
+		return "BROADCASTMESSAGE"
+	case OPERATIONALMESSAGE:
+		return "OPERATIONALMESSAGE"
+	case TIMEOUT:
+		return "TIMEOUT"
+	case REFRESHTIMER:
+		return "REFRESHTIMER"
+	case PAUSED:
+		return "PAUSED"
+	default:
+		return strconv.Itoa(messageType)
+	}
+}
+
 func getStringFromGob(message []byte) string {
 	var str string
 	err := gob.NewDecoder(bytes.NewReader(message)).Decode(&str)
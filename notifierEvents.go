@@ -0,0 +1,157 @@
+package qsutils
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultEventBuffer = 64
+
+// ClientEventType is a transition in the life of a client
+type ClientEventType int
+
+const (
+	ClientFirstRegistered   ClientEventType = iota // the first registration or poll of a client the server did not know
+	ClientRepolled                                 // a poll of a client that was already registered
+	ClientPropertiesChanged                        // a registration or poll brought properties that differ from the previous ones
+	ClientDisconnected                             // the client was removed from the registry, including at shutdown
+	ClientExpired                                  // the client missed its heartbeats, see ExpiryPolicy
+	ClientBacklogOverflow                          // a message for the client was discarded because its backlog was full
+	ClientMessageDelivered                         // a message was handed to a poll of the client
+)
+
+func (t ClientEventType) String() string {
+	switch t {
+	case ClientFirstRegistered:
+		return "first-registered"
+	case ClientRepolled:
+		return "repolled"
+	case ClientPropertiesChanged:
+		return "properties-changed"
+	case ClientDisconnected:
+		return "disconnected"
+	case ClientExpired:
+		return "expired"
+	case ClientBacklogOverflow:
+		return "backlog-overflow"
+	case ClientMessageDelivered:
+		return "message-delivered"
+	default:
+		return "unknown"
+	}
+}
+
+// ClientEvent is published to every EventSubscription interested in its type
+type ClientEvent struct {
+	Type     ClientEventType
+	ClientID string
+	Client   NotificationClient // the registration of the client when the event happened
+	Time     time.Time
+
+	// Message is the message delivered or discarded, for ClientMessageDelivered and ClientBacklogOverflow
+	Message NotificationServiceMessage
+}
+
+// EventSubscription receives client events on C. Events are never waited for: when C is full
+// the event is dropped for this subscription and counted by Dropped. C is closed by Close and
+// when the server shuts down.
+type EventSubscription struct {
+	C <-chan ClientEvent
+
+	server  *NotificationServer
+	ch      chan ClientEvent
+	types   uint64 // bit set of the ClientEventType values wanted
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// SubscribeEvents subscribes to the client events of the given types, or of every type if none
+// is given. buffer is the capacity of C; zero or less uses a default.
+func (s *NotificationServer) SubscribeEvents(buffer int, types ...ClientEventType) *EventSubscription {
+
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+
+	sub := &EventSubscription{server: s, ch: make(chan ClientEvent, buffer), types: ^uint64(0)}
+	sub.C = sub.ch
+	if len(types) > 0 {
+		sub.types = 0
+		for _, t := range types {
+			sub.types |= 1 << uint(t)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		sub.closeChannel()
+		return sub
+	}
+	if s.eventSubs == nil {
+		s.eventSubs = make(map[*EventSubscription]struct{})
+	}
+	s.eventSubs[sub] = struct{}{}
+
+	return sub
+}
+
+// Close ends the subscription and closes C
+func (e *EventSubscription) Close() {
+
+	e.server.mu.Lock()
+	defer e.server.mu.Unlock()
+
+	delete(e.server.eventSubs, e)
+	e.closeChannel()
+}
+
+// Dropped returns the number of events discarded because C was full
+func (e *EventSubscription) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+func (e *EventSubscription) closeChannel() {
+	e.once.Do(func() { close(e.ch) })
+}
+
+// publishLocked hands the event to every interested subscription without blocking
+func (s *NotificationServer) publishLocked(eventType ClientEventType, entry *notificationClientEntry, message NotificationServiceMessage) {
+
+	if len(s.eventSubs) == 0 {
+		return
+	}
+
+	event := ClientEvent{Type: eventType, ClientID: entry.info.ClientID, Client: entry.info, Time: time.Now(), Message: message}
+
+	for sub := range s.eventSubs {
+		if sub.types&(1<<uint(eventType)) == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// closeEventsLocked closes every subscription when the server shuts down
+func (s *NotificationServer) closeEventsLocked() {
+	for sub := range s.eventSubs {
+		sub.closeChannel()
+	}
+	s.eventSubs = nil
+}
+
+// forwardRegistrations adapts the event bus to a registrationHandler, which expects the client
+// of every poll on a channel of its own. A slow handler only loses events, it never holds up a poll.
+// registrations is closed when the server shuts down, so a handler ranging over it returns.
+func forwardRegistrations(sub *EventSubscription, registrations chan<- NotificationClient) {
+	defer close(registrations)
+	for event := range sub.C {
+		registrations <- event.Client
+	}
+}
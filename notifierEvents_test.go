@@ -0,0 +1,39 @@
+package qsutils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRegistrationHandlerChannelClosedOnShutdown(t *testing.T) {
+
+	registered := make(chan string, 1)
+	done := make(chan struct{})
+	s := NewNotificationServer(func(ch chan NotificationClient) {
+		for client := range ch {
+			registered <- client.ClientID
+		}
+		close(done)
+	})
+
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case clientID := <-registered:
+		if clientID != "a" {
+			t.Fatalf("handler received %q, want a", clientID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler never received the registration")
+	}
+
+	s.Shutdown(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler channel still open after Shutdown")
+	}
+}
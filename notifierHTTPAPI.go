@@ -0,0 +1,166 @@
+package qsutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxAPIRequestBytes = 16 << 20
+
+// EnableHTTPAPI serves the operations of NotificationService as a JSON API under prefix, for
+// clients that can neither use net/rpc nor JSON-RPC. Every endpoint takes a POST with a JSON
+// body and answers with JSON; []byte fields such as message bodies are base64 strings.
+//
+//	prefix/listen       NotificationClient        -> NotificationServiceMessage, held until a message arrives
+//	prefix/ack          NotificationAck           -> {"acked": n}
+//	prefix/subscribe    NotificationSubscription  -> NotificationSubscription
+//	prefix/unsubscribe  NotificationSubscription  -> NotificationSubscription
+//	prefix/clear        NotificationRegistration  -> NotificationServiceMessage
+//	prefix/disconnect   NotificationRegistration  -> NotificationServiceMessage
+//	prefix/send         NotificationSend          -> {"id": n}
+//
+// A listen works like the RPC long-poll: the reply carries the ClientID, which the client sends
+// back with its next listen, and a REFRESHTIMER reply, or TIMEOUT if the client set PollTimeout,
+// means no message arrived in time. Control replies such as these carry plain text with
+// ContentTypeText. Errors are answered with {"error": "..."} and a 4xx or 5xx status. A server
+// with an Authenticator takes the token from the Authorization header as "Bearer <token>".
+func (s *NotificationServer) EnableHTTPAPI(prefix string) {
+
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	s.mux.HandleFunc(prefix+"/listen", s.withSession(apiEndpoint(s.apiListen)))
+	s.mux.HandleFunc(prefix+"/ack", s.withSession(apiEndpoint(s.apiAck)))
+	s.mux.HandleFunc(prefix+"/subscribe", s.withSession(apiEndpoint(s.apiSubscribe)))
+	s.mux.HandleFunc(prefix+"/unsubscribe", s.withSession(apiEndpoint(s.apiUnsubscribe)))
+	s.mux.HandleFunc(prefix+"/clear", s.withSession(apiEndpoint(s.apiClear)))
+	s.mux.HandleFunc(prefix+"/disconnect", s.withSession(apiEndpoint(s.apiDisconnect)))
+	s.mux.HandleFunc(prefix+"/send", s.withSession(apiEndpoint(s.apiSend)))
+}
+
+func (s *NotificationServer) apiListen(ctx context.Context, client NotificationClient) (any, error) {
+
+	if s.disabled.Load() {
+		return textControlMessage("Disabled", DISABLED, ""), nil
+	}
+
+	client, err := sessionFromContext(ctx).authorizeClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.listenContext(ctx, client, false)
+
+	return textControl(message), err
+}
+
+func (s *NotificationServer) apiAck(ctx context.Context, ack NotificationAck) (any, error) {
+	clientID, err := sessionFromContext(ctx).clientID(ack.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"acked": s.Ack(clientID, ack.MessageIDs...)}, nil
+}
+
+func (s *NotificationServer) apiSubscribe(ctx context.Context, subscription NotificationSubscription) (any, error) {
+	clientID, err := sessionFromContext(ctx).clientID(subscription.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	topics, err := s.Subscribe(clientID, subscription.Topics...)
+	return NotificationSubscription{ClientID: clientID, Topics: topics}, err
+}
+
+func (s *NotificationServer) apiUnsubscribe(ctx context.Context, subscription NotificationSubscription) (any, error) {
+	clientID, err := sessionFromContext(ctx).clientID(subscription.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	topics, err := s.Unsubscribe(clientID, subscription.Topics...)
+	return NotificationSubscription{ClientID: clientID, Topics: topics}, err
+}
+
+func (s *NotificationServer) apiClear(ctx context.Context, registration NotificationRegistration) (any, error) {
+	clientID, err := sessionFromContext(ctx).clientID(registration.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	s.ClearBacklog(clientID)
+	return textControlMessage("Backlog Cleared", CLEARBACKLOG, clientID), nil
+}
+
+func (s *NotificationServer) apiDisconnect(ctx context.Context, registration NotificationRegistration) (any, error) {
+	clientID, err := sessionFromContext(ctx).clientID(registration.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	s.Disconnect(clientID)
+	return textControlMessage("Disconnected", DISCONNECTED, clientID), nil
+}
+
+func (s *NotificationServer) apiSend(ctx context.Context, send NotificationSend) (any, error) {
+	if err := sessionFromContext(ctx).allowSend(send); err != nil {
+		return nil, err
+	}
+	id, err := s.Send(send)
+	return map[string]uint64{"id": id}, err
+}
+
+// apiEndpoint adapts an API operation to an http.HandlerFunc that decodes the request body and encodes the reply
+func apiEndpoint[T any](operation func(ctx context.Context, request T) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		var request T
+		err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAPIRequestBytes)).Decode(&request)
+		if err != nil && !errors.Is(err, io.EOF) {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		reply, err := operation(req.Context(), request)
+		if err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+
+		writeAPIReply(w, http.StatusOK, reply)
+	}
+}
+
+func apiErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownClient):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidSend), errors.Is(err, ErrInvalidQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrClientIDMismatch), errors.Is(err, ErrPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrServerClosed), errors.Is(err, ErrBacklogFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIReply(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeAPIReply(w http.ResponseWriter, status int, reply any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
@@ -0,0 +1,173 @@
+package qsutils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+)
+
+const acceptRetryDelay = 100 * time.Millisecond
+
+var ErrInvalidSend = errors.New("invalid send request")
+
+// Send sends a message to the recipients described by the request. The reply is the ID of the message.
+func (t *NotificationService) Send(send NotificationSend, reply *uint64) error {
+
+	if err := t.session.allowSend(send); err != nil {
+		return err
+	}
+
+	id, err := t.server.Send(send)
+	if err != nil {
+		return err
+	}
+	*reply = id
+
+	return nil
+}
+
+// Send sends the message described by a NotificationSend, as SendMessageToClient, SendToTopic,
+// SendMessageWhere or SendBroadcastMessage would, and returns the ID it was given.
+func (s *NotificationServer) Send(send NotificationSend) (uint64, error) {
+
+	message, err := send.message()
+	if err != nil {
+		return 0, err
+	}
+
+	var selector *ClientSelector
+	if send.Selector != "" {
+		if selector, err = ParseClientSelector(send.Selector); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidSend, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrServerClosed
+	}
+
+	s.assignIDLocked(&message)
+
+	switch {
+	case send.ClientID != "":
+		err = s.sendMessageToClientLocked(send.ClientID, message)
+	case send.Topic != "":
+		err = s.sendToTopicLocked(send.Topic, message)
+	case selector != nil:
+		err = s.sendMessageToClientsLocked(s.matchClientsLocked(selector.Match), message)
+	default:
+		err = s.broadcastLocked(message)
+	}
+
+	return message.ID, err
+}
+
+// message checks the request and builds the message to send
+func (send NotificationSend) message() (NotificationServiceMessage, error) {
+
+	targets := 0
+	for _, set := range []bool{send.ClientID != "", send.Topic != "", send.Selector != "", send.Broadcast} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return NotificationServiceMessage{}, fmt.Errorf("%w: exactly one of ClientID, Topic, Selector and Broadcast must be set", ErrInvalidSend)
+	}
+	if len(send.Message) > 0 && len(send.Payload) > 0 {
+		return NotificationServiceMessage{}, fmt.Errorf("%w: only one of Message and Payload can be set", ErrInvalidSend)
+	}
+
+	message := NotificationServiceMessage{
+		Message:     send.Message,
+		MessageType: send.MessageType,
+		Priority:    send.Priority,
+		ExpiresAt:   send.ExpiresAt,
+		ContentType: send.ContentType,
+	}
+	if len(send.Payload) > 0 {
+		message.Message = send.Payload
+		if message.ContentType == "" {
+			message.ContentType = ContentTypeJSON
+		}
+	}
+	if message.MessageType == 0 {
+		message.MessageType = MESSAGE
+		if send.Broadcast {
+			message.MessageType = BROADCASTMESSAGE
+		}
+	}
+
+	return message, nil
+}
+
+// ServeJSONRPC serves NotificationService with JSON-RPC 1.0, as implemented by net/rpc/jsonrpc,
+// on a listener of its own, for clients that cannot use gob. Each request is a JSON object
+// {"method": "NotificationService.Listen", "params": [{...}], "id": n}; message bodies are base64
+// strings, and control replies such as REFRESHTIMER carry plain text with ContentTypeText. It
+// shares the registry of the server and is closed by Shutdown.
+func (s *NotificationServer) ServeJSONRPC(protocol string, endpoint string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	if err := s.loadStoreLocked(); err != nil {
+		return err
+	}
+
+	l, err := s.listenLocked(protocol, endpoint)
+	if err != nil {
+		return err
+	}
+	s.jsonListeners = append(s.jsonListeners, l)
+
+	go s.acceptJSONRPC(l)
+
+	return nil
+}
+
+func (s *NotificationServer) acceptJSONRPC(l net.Listener) {
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// such as running out of file descriptors, give the process time to recover
+			log.Print("json-rpc accept: ", err.Error())
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		go func() {
+			if !s.trackConn(conn) {
+				conn.Close()
+				return
+			}
+			defer s.untrackConn(conn)
+
+			peerClientID, err := s.connPeerClientID(conn)
+			if err != nil {
+				log.Print("json-rpc handshake with ", conn.RemoteAddr(), ": ", err.Error())
+				conn.Close()
+				return
+			}
+
+			rpcServer := rpc.NewServer()
+			rpcServer.Register(&NotificationService{server: s, session: s.newSession(peerClientID), plainControl: true})
+			rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}()
+	}
+}
@@ -0,0 +1,559 @@
+package qsutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrListenerClosed = errors.New("notification listener closed")
+var ErrServerSilent = errors.New("notification server stopped answering")
+
+const (
+	defaultMinBackoff    = 500 * time.Millisecond
+	defaultMaxBackoff    = 30 * time.Second
+	defaultDisabledRetry = 10 * time.Second
+)
+
+// ConnectionState is the state of the connection between a NotificationListener and the server
+type ConnectionState int
+
+const (
+	ListenerDisconnected ConnectionState = iota
+	ListenerConnecting
+	ListenerConnected
+	ListenerDisabled // connected, but the server has notifications disabled
+	ListenerClosed
+	ListenerPaused // connected, but the server has paused delivery to this client
+)
+
+func (c ConnectionState) String() string {
+	switch c {
+	case ListenerDisconnected:
+		return "disconnected"
+	case ListenerConnecting:
+		return "connecting"
+	case ListenerConnected:
+		return "connected"
+	case ListenerDisabled:
+		return "disabled"
+	case ListenerClosed:
+		return "closed"
+	case ListenerPaused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+// NotificationListener is a long-lived client of the notification server. It keeps a single
+// RPC connection open, reconnects with exponential backoff and jitter when the server goes away
+// and reports connection state changes through OnStateChange instead of exiting the process.
+type NotificationListener struct {
+	Protocol string
+	Address  string
+	Client   NotificationClient
+
+	MinBackoff    time.Duration // delay before the first reconnect attempt
+	MaxBackoff    time.Duration // upper bound of the reconnect delay
+	DisabledRetry time.Duration // how long to wait before polling again when the server is disabled or has paused the client
+
+	// TLSConfig, if set, connects to the server over TLS. Use NewClientTLSConfig to add a client
+	// certificate for mutual TLS.
+	TLSConfig *tls.Config
+
+	BatchMaxMessages int // most messages NextBatch asks for, zero leaves it to the server
+	BatchMaxBytes    int // most bytes of message bodies NextBatch asks for, zero leaves it to the server
+
+	// ServerTimeout is how long a poll may go unanswered before the server is taken to be gone
+	// and the listener reconnects. Zero allows twice the poll timeout or refresh interval the
+	// server reports at registration, or waits forever on a server that does not report one.
+	ServerTimeout time.Duration
+
+	// OnStateChange is called from the goroutine calling Next whenever the connection state changes.
+	// err carries the reason for the change, if there is one.
+	OnStateChange func(state ConnectionState, err error)
+
+	mu           sync.Mutex
+	rpcClient    *rpc.Client
+	state        ConnectionState
+	reconnecting bool // a dial has failed, keep the state at disconnected until one succeeds
+	closed       bool
+	registration NotificationRegistration // the reply to the last registration
+}
+
+// NewNotificationListener creates a listener for the server at address. The server issues the
+// client an ID on the first connection, which is kept for the life of the listener. Set
+// Client.ClientID before the first call to Next to keep the same identity across restarts.
+func NewNotificationListener(protocol, address string) *NotificationListener {
+	return &NotificationListener{
+		Protocol:      protocol,
+		Address:       address,
+		Client:        NotificationClient{ProcessID: os.Getpid()},
+		MinBackoff:    defaultMinBackoff,
+		MaxBackoff:    defaultMaxBackoff,
+		DisabledRetry: defaultDisabledRetry,
+	}
+}
+
+// Next polls the server until a message arrives for this client and returns it. Connection
+// failures are retried with backoff; Next only returns an error when the context is done, the
+// listener is closed or the server rejects the call.
+func (l *NotificationListener) Next(ctx context.Context) (NotificationServiceMessage, error) {
+
+	for {
+		var reply NotificationServiceMessage
+		err := l.poll(ctx, "NotificationService.Listen", func(client NotificationClient) any { return client }, &reply)
+		if err != nil {
+			return NotificationServiceMessage{}, err
+		}
+
+		if reply.MessageType == DISABLED || reply.MessageType == PAUSED {
+			if err := l.waitWhileDisabled(ctx, reply.MessageType); err != nil {
+				return NotificationServiceMessage{}, err
+			}
+			continue
+		}
+
+		l.setState(ListenerConnected, nil)
+
+		return reply, nil
+	}
+}
+
+// NextBatch is like Next, but returns up to BatchMaxMessages messages, or BatchMaxBytes of
+// message bodies, in a single reply. The server may lower both limits.
+func (l *NotificationListener) NextBatch(ctx context.Context) ([]NotificationServiceMessage, error) {
+
+	for {
+		var reply NotificationServiceBatch
+		err := l.poll(ctx, "NotificationService.ListenBatch", func(client NotificationClient) any {
+			return NotificationBatchRequest{Client: client, MaxMessages: l.BatchMaxMessages, MaxBytes: l.BatchMaxBytes}
+		}, &reply)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply.Messages) == 1 && (reply.Messages[0].MessageType == DISABLED || reply.Messages[0].MessageType == PAUSED) {
+			if err := l.waitWhileDisabled(ctx, reply.Messages[0].MessageType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		l.setState(ListenerConnected, nil)
+
+		return reply.Messages, nil
+	}
+}
+
+// poll makes a long-poll call, reconnecting with backoff until it succeeds. args builds the
+// arguments of the call from the client registration.
+func (l *NotificationListener) poll(ctx context.Context, method string, args func(client NotificationClient) any, reply any) error {
+
+	attempt := 0
+
+	for {
+		rpcClient, err := l.connect(ctx)
+		if err != nil {
+			if l.isClosed() {
+				return ErrListenerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if isServerError(err) {
+				return err
+			}
+			l.setState(ListenerDisconnected, err)
+			if err := sleepContext(ctx, l.backoff(attempt)); err != nil {
+				return err
+			}
+			attempt++
+			continue
+		}
+
+		// subscriptions are sent when registering on connect. Sending them with every poll would
+		// undo an Unsubscribe racing with the poll.
+		client := l.clientInfo()
+		client.Topics = nil
+
+		callCtx, cancel := l.pollContext(ctx)
+		err = l.callContext(callCtx, rpcClient, method, args(client), reply)
+		cancel()
+
+		switch {
+		case err == nil:
+			return nil
+		case l.isClosed():
+			return ErrListenerClosed
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case isServerError(err):
+			return err
+		default:
+			// the connection has gone, start again with a fresh one
+			l.dropClient(rpcClient, err)
+			if err := sleepContext(ctx, l.backoff(attempt)); err != nil {
+				return err
+			}
+			attempt++
+		}
+	}
+}
+
+// pollContext limits a poll to ServerTimeout, so that a server that stops answering without
+// closing the connection is noticed
+func (l *NotificationListener) pollContext(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	l.mu.Lock()
+	timeout := l.ServerTimeout
+	if timeout <= 0 && l.registration.PollTimeout > 0 {
+		timeout = 2 * l.registration.PollTimeout
+	}
+	if timeout <= 0 {
+		timeout = 2 * l.registration.RefreshInterval
+	}
+	l.mu.Unlock()
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, timeout, ErrServerSilent)
+}
+
+// waitWhileDisabled waits before polling a server that answered DISABLED, or PAUSED for this client, again
+func (l *NotificationListener) waitWhileDisabled(ctx context.Context, messageType int) error {
+	if messageType == PAUSED {
+		l.setState(ListenerPaused, nil)
+	} else {
+		l.setState(ListenerDisabled, nil)
+	}
+	return sleepContext(ctx, l.DisabledRetry)
+}
+
+// ClearBacklog asks the server to discard the messages queued for this client
+func (l *NotificationListener) ClearBacklog(ctx context.Context) error {
+	var reply NotificationServiceMessage
+	return l.call(ctx, "NotificationService.ClearBacklog", l.ClientID(), &reply)
+}
+
+// Disconnect removes the registration of this client from the server
+func (l *NotificationListener) Disconnect(ctx context.Context) error {
+	var reply NotificationServiceMessage
+	return l.call(ctx, "NotificationService.Disconnect", l.ClientID(), &reply)
+}
+
+// Ack acknowledges messages received by this client. It does nothing unless Client.Acknowledge is set.
+func (l *NotificationListener) Ack(ctx context.Context, messageIDs ...uint64) error {
+	if !l.clientInfo().Acknowledge {
+		return nil
+	}
+	var acked int
+	return l.call(ctx, "NotificationService.Ack", NotificationAck{ClientID: l.ClientID(), MessageIDs: messageIDs}, &acked)
+}
+
+// Heartbeat tells the server that this client is alive, for applications that stop calling Next
+// for longer than HeartbeatInterval. Polls count as heartbeats.
+func (l *NotificationListener) Heartbeat(ctx context.Context) error {
+	var reply NotificationRegistration
+	return l.call(ctx, "NotificationService.Heartbeat", l.ClientID(), &reply)
+}
+
+// HeartbeatInterval returns the heartbeat interval agreed with the server at the last
+// registration, zero if the client never expires or has not registered yet
+func (l *NotificationListener) HeartbeatInterval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.registration.HeartbeatInterval
+}
+
+// Subscribe adds topics to the subscriptions of this client. The topics are also added to
+// Client.Topics so that they are restored if the server loses the registration.
+func (l *NotificationListener) Subscribe(ctx context.Context, topics ...string) error {
+
+	var reply NotificationSubscription
+	if err := l.call(ctx, "NotificationService.Subscribe", NotificationSubscription{ClientID: l.ClientID(), Topics: topics}, &reply); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.Client.Topics = reply.Topics
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Unsubscribe removes topics from the subscriptions of this client
+func (l *NotificationListener) Unsubscribe(ctx context.Context, topics ...string) error {
+
+	var reply NotificationSubscription
+	if err := l.call(ctx, "NotificationService.Unsubscribe", NotificationSubscription{ClientID: l.ClientID(), Topics: topics}, &reply); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.Client.Topics = reply.Topics
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Close closes the connection to the server and makes any blocked Next return ErrListenerClosed
+func (l *NotificationListener) Close() error {
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	rpcClient := l.rpcClient
+	l.rpcClient = nil
+	l.mu.Unlock()
+
+	l.setState(ListenerClosed, nil)
+
+	if rpcClient != nil {
+		return rpcClient.Close()
+	}
+	return nil
+}
+
+// call makes a single RPC call on the current connection, connecting first if there is none
+func (l *NotificationListener) call(ctx context.Context, method string, args any, reply any) error {
+
+	rpcClient, err := l.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = l.callContext(ctx, rpcClient, method, args, reply)
+	if err != nil && !isServerError(err) {
+		l.dropClient(rpcClient, err)
+	}
+
+	return err
+}
+
+// callContext makes the call and abandons it if the context is done, returning the cause. net/rpc
+// cannot cancel a call, so the connection is closed to release it.
+func (l *NotificationListener) callContext(ctx context.Context, rpcClient *rpc.Client, method string, args any, reply any) error {
+
+	call := rpcClient.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		l.dropClient(rpcClient, context.Cause(ctx))
+		return context.Cause(ctx)
+	}
+}
+
+// connect returns the current connection or dials a new one
+func (l *NotificationListener) connect(ctx context.Context) (*rpc.Client, error) {
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrListenerClosed
+	}
+	if l.rpcClient != nil {
+		defer l.mu.Unlock()
+		return l.rpcClient, nil
+	}
+	reconnecting := l.reconnecting
+	l.mu.Unlock()
+
+	if !reconnecting {
+		l.setState(ListenerConnecting, nil)
+	}
+
+	conn, err := dialRPC(ctx, l.Protocol, l.Address, l.TLSConfig)
+	if err != nil {
+		l.mu.Lock()
+		l.reconnecting = true
+		l.mu.Unlock()
+		return nil, err
+	}
+	rpcClient := rpc.NewClient(conn)
+
+	// register on every new connection, so that the server knows the client before its first
+	// poll and issues an ID if the client does not have one yet
+	var registration NotificationRegistration
+	call := rpcClient.Go("NotificationService.Register", l.clientInfo(), &registration, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		rpcClient.Close()
+		l.mu.Lock()
+		l.reconnecting = true
+		l.mu.Unlock()
+		return nil, err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		rpcClient.Close()
+		return nil, ErrListenerClosed
+	}
+	l.rpcClient = rpcClient
+	l.Client.ClientID = registration.ClientID
+	l.registration = registration
+	l.reconnecting = false
+	l.mu.Unlock()
+
+	l.setState(ListenerConnected, nil)
+
+	return rpcClient, nil
+}
+
+// dropClient closes the connection if it is still the current one
+func (l *NotificationListener) dropClient(rpcClient *rpc.Client, err error) {
+
+	l.mu.Lock()
+	current := l.rpcClient == rpcClient
+	if current {
+		l.rpcClient = nil
+	}
+	closed := l.closed
+	l.mu.Unlock()
+
+	if current {
+		rpcClient.Close()
+		if !closed {
+			l.setState(ListenerDisconnected, err)
+		}
+	}
+}
+
+// ClientID returns the ID the server knows this client by. It is empty until the first
+// connection if the server is left to issue it.
+func (l *NotificationListener) ClientID() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Client.ClientID
+}
+
+func (l *NotificationListener) clientInfo() NotificationClient {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Client
+}
+
+func (l *NotificationListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *NotificationListener) setState(state ConnectionState, err error) {
+
+	l.mu.Lock()
+	changed := l.state != state
+	l.state = state
+	l.mu.Unlock()
+
+	if changed && l.OnStateChange != nil {
+		l.OnStateChange(state, err)
+	}
+}
+
+// State returns the current connection state
+func (l *NotificationListener) State() ConnectionState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+func (l *NotificationListener) backoff(attempt int) time.Duration {
+	return backoffDelay(l.MinBackoff, l.MaxBackoff, attempt)
+}
+
+// backoffDelay returns the delay before reconnect attempt n, exponential with full jitter and never above maxBackoff
+func backoffDelay(minBackoff, maxBackoff time.Duration, attempt int) time.Duration {
+
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+
+	delay := maxBackoff
+	if attempt < 30 {
+		delay = min(minBackoff<<attempt, maxBackoff)
+	}
+
+	return min(minBackoff/2+time.Duration(rand.Int63n(int64(delay))), maxBackoff)
+}
+
+// dialRPC connects to the server, over TLS if tlsConfig is set, and performs the HTTP CONNECT
+// handshake used by rpc.DialHTTP
+func dialRPC(ctx context.Context, protocol, address string, tlsConfig *tls.Config) (net.Conn, error) {
+
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		d := tls.Dialer{Config: tlsConfig}
+		conn, err = d.DialContext(ctx, protocol, address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, protocol, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rpcHandshake(conn)
+}
+
+func rpcHandshake(conn net.Conn) (net.Conn, error) {
+
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: conn.RemoteAddr().Network(), Addr: conn.RemoteAddr(), Err: err}
+	}
+
+	return conn, nil
+}
+
+func isServerError(err error) bool {
+	var serverError rpc.ServerError
+	return errors.As(err, &serverError)
+}
+
+// sleepContext sleeps for d or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
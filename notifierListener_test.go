@@ -0,0 +1,34 @@
+package qsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelayStaysWithinLimits(t *testing.T) {
+
+	minBackoff, maxBackoff := 100*time.Millisecond, time.Second
+
+	for attempt := 0; attempt < 40; attempt++ {
+		for i := 0; i < 200; i++ {
+			delay := backoffDelay(minBackoff, maxBackoff, attempt)
+			if delay > maxBackoff {
+				t.Fatalf("attempt %d: delay %v exceeds MaxBackoff %v", attempt, delay, maxBackoff)
+			}
+			if delay < minBackoff/2 {
+				t.Fatalf("attempt %d: delay %v is below half of MinBackoff %v", attempt, delay, minBackoff)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayWithMaxBelowMin(t *testing.T) {
+
+	minBackoff := time.Second
+
+	for i := 0; i < 200; i++ {
+		if delay := backoffDelay(minBackoff, 0, 5); delay > minBackoff {
+			t.Fatalf("delay %v exceeds MinBackoff %v, which stands in for a smaller MaxBackoff", delay, minBackoff)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package qsutils
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	defaultMissedHeartbeats = 3
+	minHeartbeatInterval    = time.Second
+)
+
+// ExpiryPolicy decides what happens to a client that has missed too many heartbeats
+type ExpiryPolicy int
+
+const (
+	ExpirePurgeBacklog  ExpiryPolicy = iota // disconnect the client, handing its backlog to ExpirySink if one is set
+	ExpireRetainBacklog                     // keep the client and keep queuing its messages until it comes back
+)
+
+func (p ExpiryPolicy) String() string {
+	switch p {
+	case ExpirePurgeBacklog:
+		return "purge"
+	case ExpireRetainBacklog:
+		return "retain"
+	default:
+		return "unknown"
+	}
+}
+
+// Heartbeat tells the server that the client is alive without polling. The reply repeats the
+// negotiated intervals.
+func (t *NotificationService) Heartbeat(clientID string, reply *NotificationRegistration) error {
+
+	clientID, err := t.clientID(clientID)
+	if err != nil {
+		return err
+	}
+
+	interval, err := t.server.Heartbeat(clientID)
+	if err != nil {
+		return err
+	}
+	*reply = NotificationRegistration{ClientID: clientID, HeartbeatInterval: interval, RefreshInterval: t.server.RefreshInterval}
+
+	return nil
+}
+
+// Heartbeat records that the client is alive and returns its heartbeat interval. A client that
+// has expired and was disconnected gets ErrUnknownClient and has to register again.
+func (s *NotificationServer) Heartbeat(clientID string) (time.Duration, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return 0, ErrUnknownClient
+	}
+	s.touchLocked(entry)
+
+	return entry.heartbeat, nil
+}
+
+// heartbeatInterval negotiates the heartbeat interval of a client: the one it asks for, or the
+// server default, capped by MaxHeartbeatInterval. Zero means the client never expires.
+func (s *NotificationServer) heartbeatInterval(requested time.Duration) time.Duration {
+
+	interval := s.HeartbeatInterval
+	if requested > 0 {
+		interval = max(requested, minHeartbeatInterval)
+	}
+	if s.MaxHeartbeatInterval > 0 && interval > s.MaxHeartbeatInterval {
+		interval = s.MaxHeartbeatInterval
+	}
+
+	return interval
+}
+
+// expiryWindow is how long the client may stay away before it expires
+func (s *NotificationServer) expiryWindow(entry *notificationClientEntry) time.Duration {
+	missed := s.MissedHeartbeats
+	if missed <= 0 {
+		missed = defaultMissedHeartbeats
+	}
+	return entry.heartbeat * time.Duration(missed)
+}
+
+// touchLocked records that the client has been seen and restarts its expiry timer
+func (s *NotificationServer) touchLocked(entry *notificationClientEntry) {
+
+	entry.lastSeen = time.Now()
+	entry.expired = false
+
+	if entry.heartbeat <= 0 || s.closed {
+		entry.stopExpiryTimer()
+		return
+	}
+
+	window := s.expiryWindow(entry)
+	if entry.expiryTimer != nil {
+		entry.expiryTimer.Reset(window)
+		return
+	}
+
+	clientID := entry.info.ClientID
+	entry.expiryTimer = time.AfterFunc(window, func() {
+		s.checkExpiry(clientID, entry)
+	})
+}
+
+// checkExpiry expires the client if it has not been seen for the expiry window. A client with a
+// poll waiting is alive: the poll is released by the refresh timer, and the next one is a heartbeat.
+// Nobody expires while the server is disabled, as polls are then answered without being recorded.
+func (s *NotificationServer) checkExpiry(clientID string, entry *notificationClientEntry) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients[clientID] != entry || entry.expiryTimer == nil || entry.expired {
+		return
+	}
+
+	window := s.expiryWindow(entry)
+	if entry.listener != nil || s.disabled.Load() {
+		entry.expiryTimer.Reset(window)
+		return
+	}
+	if remaining := window - time.Since(entry.lastSeen); remaining > 0 {
+		entry.expiryTimer.Reset(remaining)
+		return
+	}
+
+	s.expireLocked(entry)
+}
+
+func (s *NotificationServer) expireLocked(entry *notificationClientEntry) {
+
+	clientID := entry.info.ClientID
+	s.metrics.expirations++
+	s.publishLocked(ClientExpired, entry, NotificationServiceMessage{})
+
+	if s.ExpiryPolicy == ExpireRetainBacklog {
+		// delivered messages will not be acknowledged, so they belong in the backlog again
+		entry.expired = true
+		s.requeueInflightLocked(entry)
+		return
+	}
+
+	if s.ExpirySink != nil {
+		entry.stopInflightTimers()
+		inflight := entry.inflightInOrder()
+		for i := len(inflight) - 1; i >= 0; i-- {
+			entry.pushBacklogFront(inflight[i])
+		}
+		entry.inflight = make(map[uint64]*inflightMessage)
+		if backlog := entry.drainBacklog(); len(backlog) > 0 {
+			go func() {
+				if err := s.ExpirySink(clientID, backlog); err != nil {
+					log.Printf("expiry sink: backlog of client %s: %v", clientID, err)
+				}
+			}()
+		}
+	}
+
+	s.disconnectLocked(clientID)
+}
+
+func (c *notificationClientEntry) stopExpiryTimer() {
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+		c.expiryTimer = nil
+	}
+}
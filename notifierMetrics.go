@@ -0,0 +1,320 @@
+package qsutils
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollWaitBuckets are the upper bounds, in seconds, of the long-poll wait histogram
+var pollWaitBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30, 60}
+
+// Reasons a message is discarded without being delivered, the reason label of notifier_messages_dropped_total
+const (
+	dropExpired    = "expired"
+	dropOverflow   = "overflow"
+	dropDeadLetter = "dead_letter"
+)
+
+// serverMetrics counts what the server does for the metrics endpoint. The counters are guarded
+// by the mutex of the server, the histograms, which are observed outside it, by their own.
+type serverMetrics struct {
+	sent          map[int]uint64    // messages handed to a client, by message type
+	dropped       map[string]uint64 // by reason
+	redelivered   uint64
+	refreshes     uint64
+	timeouts      uint64
+	registrations uint64
+	disconnects   uint64
+	expirations   uint64
+
+	histogramMu sync.Mutex
+	pollWait    map[int]*histogram // by the message type of the reply
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative, with a last one for +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(pollWaitBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (m *serverMetrics) countSentLocked(messageType int) {
+	if m.sent == nil {
+		m.sent = make(map[int]uint64)
+	}
+	m.sent[messageType]++
+}
+
+func (m *serverMetrics) countDroppedLocked(reason string, n int) {
+	if m.dropped == nil {
+		m.dropped = make(map[string]uint64)
+	}
+	m.dropped[reason] += uint64(n)
+}
+
+// observePollWait records how long a poll waited for its reply
+func (m *serverMetrics) observePollWait(messageType int, wait time.Duration) {
+
+	m.histogramMu.Lock()
+	defer m.histogramMu.Unlock()
+
+	if m.pollWait == nil {
+		m.pollWait = make(map[int]*histogram)
+	}
+	h, ok := m.pollWait[messageType]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(pollWaitBuckets)+1)}
+		m.pollWait[messageType] = h
+	}
+	h.observe(wait.Seconds())
+}
+
+// EnableMetrics serves the metrics of the server at path in the Prometheus text exposition
+// format. On a server with an Authenticator the scraper needs a token with PermissionAdmin.
+// Series labelled by client ID are only served with MetricsPerClient.
+func (s *NotificationServer) EnableMetrics(path string) {
+	s.mux.HandleFunc(path, s.serveMetrics)
+}
+
+func (s *NotificationServer) serveMetrics(w http.ResponseWriter, req *http.Request) {
+
+	session, err := s.requestSession(req)
+	if err == nil {
+		err = session.allow(PermissionAdmin)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	s.writeMetrics(bw)
+	bw.Flush()
+}
+
+// metricsSnapshot is a copy of the metrics taken under the mutex of the server, so that writing
+// them to a slow scraper holds up nothing else
+type metricsSnapshot struct {
+	sent          map[int]uint64
+	dropped       map[string]uint64
+	redelivered   uint64
+	refreshes     uint64
+	timeouts      uint64
+	registrations uint64
+	disconnects   uint64
+	expirations   uint64
+
+	clients, polling, paused, connections   int
+	backlogMessages, backlogBytes, inflight int
+	scheduled                               int
+	disabled                                bool
+
+	perClient []clientMetrics // by client ID, only with MetricsPerClient
+	pollWait  map[int]histogram
+}
+
+type clientMetrics struct {
+	clientID                                string
+	backlogMessages, backlogBytes, inflight int
+}
+
+func (s *NotificationServer) snapshotMetrics() metricsSnapshot {
+
+	s.mu.Lock()
+
+	m := &s.metrics
+	snap := metricsSnapshot{
+		sent:          make(map[int]uint64, len(m.sent)),
+		dropped:       make(map[string]uint64, len(m.dropped)),
+		redelivered:   m.redelivered,
+		refreshes:     m.refreshes,
+		timeouts:      m.timeouts,
+		registrations: m.registrations,
+		disconnects:   m.disconnects,
+		expirations:   m.expirations,
+		clients:       len(s.clients),
+		connections:   len(s.conns),
+		scheduled:     s.schedule.Len(),
+		disabled:      s.disabled.Load(),
+	}
+	for messageType, n := range m.sent {
+		snap.sent[messageType] = n
+	}
+	for reason, n := range m.dropped {
+		snap.dropped[reason] = n
+	}
+
+	for clientID, entry := range s.clients {
+		if entry.listener != nil {
+			snap.polling++
+		}
+		if entry.paused {
+			snap.paused++
+		}
+		snap.backlogMessages += entry.backlog.Len()
+		snap.backlogBytes += entry.backlogBytes
+		snap.inflight += len(entry.inflight)
+		if s.MetricsPerClient {
+			snap.perClient = append(snap.perClient, clientMetrics{
+				clientID:        clientID,
+				backlogMessages: entry.backlog.Len(),
+				backlogBytes:    entry.backlogBytes,
+				inflight:        len(entry.inflight),
+			})
+		}
+	}
+
+	s.mu.Unlock()
+
+	sort.Slice(snap.perClient, func(i, j int) bool { return snap.perClient[i].clientID < snap.perClient[j].clientID })
+
+	m.histogramMu.Lock()
+	snap.pollWait = make(map[int]histogram, len(m.pollWait))
+	for messageType, h := range m.pollWait {
+		snap.pollWait[messageType] = histogram{counts: append([]uint64(nil), h.counts...), sum: h.sum, count: h.count}
+	}
+	m.histogramMu.Unlock()
+
+	return snap
+}
+
+// writeMetrics writes a consistent snapshot of the metrics
+func (s *NotificationServer) writeMetrics(w *bufio.Writer) {
+
+	m := s.snapshotMetrics()
+
+	writeMetricHeader(w, "notifier_messages_sent_total", "counter", "Messages handed to a client, delivered or queued, by message type.")
+	for _, messageType := range sortedKeys(m.sent) {
+		writeSample(w, "notifier_messages_sent_total", m.sent[messageType], "type", MessageTypeName(messageType))
+	}
+
+	writeMetricHeader(w, "notifier_messages_dropped_total", "counter", "Messages discarded without being delivered, by reason.")
+	for _, reason := range []string{dropExpired, dropOverflow, dropDeadLetter} {
+		writeSample(w, "notifier_messages_dropped_total", m.dropped[reason], "reason", reason)
+	}
+
+	writeMetricHeader(w, "notifier_messages_redelivered_total", "counter", "Unacknowledged messages queued again for delivery.")
+	writeSample(w, "notifier_messages_redelivered_total", m.redelivered)
+
+	writeMetricHeader(w, "notifier_refresh_timer_fires_total", "counter", "Polls released with REFRESHTIMER because no message arrived in time.")
+	writeSample(w, "notifier_refresh_timer_fires_total", m.refreshes)
+
+	writeMetricHeader(w, "notifier_poll_timeouts_total", "counter", "Polls released with TIMEOUT at the end of the poll timeout the client asked for.")
+	writeSample(w, "notifier_poll_timeouts_total", m.timeouts)
+
+	writeMetricHeader(w, "notifier_registrations_total", "counter", "Clients added to the registry.")
+	writeSample(w, "notifier_registrations_total", m.registrations)
+
+	writeMetricHeader(w, "notifier_disconnects_total", "counter", "Clients removed from the registry.")
+	writeSample(w, "notifier_disconnects_total", m.disconnects)
+
+	writeMetricHeader(w, "notifier_clients_expired_total", "counter", "Clients that missed their heartbeats.")
+	writeSample(w, "notifier_clients_expired_total", m.expirations)
+
+	writeMetricHeader(w, "notifier_clients", "gauge", "Registered clients.")
+	writeSample(w, "notifier_clients", m.clients)
+
+	writeMetricHeader(w, "notifier_clients_polling", "gauge", "Clients with a poll waiting for a message.")
+	writeSample(w, "notifier_clients_polling", m.polling)
+
+	writeMetricHeader(w, "notifier_clients_paused", "gauge", "Clients whose delivery is paused.")
+	writeSample(w, "notifier_clients_paused", m.paused)
+
+	writeMetricHeader(w, "notifier_connections", "gauge", "Open RPC, WebSocket and JSON-RPC connections.")
+	writeSample(w, "notifier_connections", m.connections)
+
+	writeMetricHeader(w, "notifier_backlog_messages", "gauge", "Messages queued for all clients.")
+	writeSample(w, "notifier_backlog_messages", m.backlogMessages)
+
+	writeMetricHeader(w, "notifier_backlog_bytes", "gauge", "Bytes of the messages queued for all clients.")
+	writeSample(w, "notifier_backlog_bytes", m.backlogBytes)
+
+	writeMetricHeader(w, "notifier_inflight_messages", "gauge", "Messages delivered and waiting for an acknowledgement, for all clients.")
+	writeSample(w, "notifier_inflight_messages", m.inflight)
+
+	if len(m.perClient) > 0 {
+		writeMetricHeader(w, "notifier_client_backlog_messages", "gauge", "Messages queued for a client.")
+		for _, c := range m.perClient {
+			writeSample(w, "notifier_client_backlog_messages", c.backlogMessages, "client_id", c.clientID)
+		}
+
+		writeMetricHeader(w, "notifier_client_backlog_bytes", "gauge", "Bytes of the messages queued for a client.")
+		for _, c := range m.perClient {
+			writeSample(w, "notifier_client_backlog_bytes", c.backlogBytes, "client_id", c.clientID)
+		}
+
+		writeMetricHeader(w, "notifier_client_inflight_messages", "gauge", "Messages delivered to a client and waiting for an acknowledgement.")
+		for _, c := range m.perClient {
+			writeSample(w, "notifier_client_inflight_messages", c.inflight, "client_id", c.clientID)
+		}
+	}
+
+	writeMetricHeader(w, "notifier_scheduled_messages", "gauge", "Messages scheduled for later delivery.")
+	writeSample(w, "notifier_scheduled_messages", m.scheduled)
+
+	disabled := 0
+	if m.disabled {
+		disabled = 1
+	}
+	writeMetricHeader(w, "notifier_disabled", "gauge", "1 if the server is disabled.")
+	writeSample(w, "notifier_disabled", disabled)
+
+	writeMetricHeader(w, "notifier_poll_wait_seconds", "histogram", "Time a poll waited for its reply, by the message type of the reply.")
+	for _, messageType := range sortedKeys(m.pollWait) {
+		h, typeName := m.pollWait[messageType], MessageTypeName(messageType)
+		cumulative := uint64(0)
+		for i, bound := range pollWaitBuckets {
+			cumulative += h.counts[i]
+			writeSample(w, "notifier_poll_wait_seconds_bucket", cumulative, "type", typeName, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		writeSample(w, "notifier_poll_wait_seconds_bucket", h.count, "type", typeName, "le", "+Inf")
+		writeSample(w, "notifier_poll_wait_seconds_sum", h.sum, "type", typeName)
+		writeSample(w, "notifier_poll_wait_seconds_count", h.count, "type", typeName)
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeSample writes one sample; labels are name and value pairs
+func writeSample(w *bufio.Writer, name string, value any, labels ...string) {
+
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
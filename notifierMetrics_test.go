@@ -0,0 +1,42 @@
+package qsutils
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T, s *NotificationServer) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	return string(body)
+}
+
+func TestMetricsBacklogGauges(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{Message: getGobFromString("queued"), MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	body := scrapeMetrics(t, s)
+	for _, want := range []string{"\nnotifier_clients 1\n", "\nnotifier_backlog_messages 1\n", `notifier_messages_sent_total{type="MESSAGE"} 1`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if strings.Contains(body, "client_id=") {
+		t.Error("per-client series served without MetricsPerClient")
+	}
+
+	s.MetricsPerClient = true
+	if body := scrapeMetrics(t, s); !strings.Contains(body, `notifier_client_backlog_messages{client_id="a"} 1`) {
+		t.Error("per-client backlog series missing with MetricsPerClient")
+	}
+}
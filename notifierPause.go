@@ -0,0 +1,169 @@
+package qsutils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// PauseClient stops delivery to the client, for example while its display is under maintenance.
+// Messages sent to it accumulate in its backlog, subject to the backlog limits, until ResumeClient.
+// With PauseReply a poll the client has waiting is answered with PAUSED at once.
+func (s *NotificationServer) PauseClient(clientID string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return ErrUnknownClient
+	}
+	s.pauseLocked(entry)
+
+	return nil
+}
+
+// ResumeClient resumes delivery to a paused client, starting with its backlog
+func (s *NotificationServer) ResumeClient(clientID string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return ErrUnknownClient
+	}
+	s.resumeLocked(entry)
+
+	return nil
+}
+
+// PauseWhere pauses every client whose properties currently satisfy the selector expression and returns their IDs
+func (s *NotificationServer) PauseWhere(selector string) ([]string, error) {
+	return s.setPausedWhere(selector, true)
+}
+
+// ResumeWhere resumes every client whose properties currently satisfy the selector expression and returns their IDs
+func (s *NotificationServer) ResumeWhere(selector string) ([]string, error) {
+	return s.setPausedWhere(selector, false)
+}
+
+// Paused reports whether delivery to the client is paused
+func (s *NotificationServer) Paused(clientID string) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	return ok && entry.paused
+}
+
+func (s *NotificationServer) setPausedWhere(selector string, paused bool) ([]string, error) {
+
+	compiled, err := ParseClientSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientIDs := s.matchClientsLocked(compiled.Match)
+	sort.Strings(clientIDs)
+
+	for _, clientID := range clientIDs {
+		if paused {
+			s.pauseLocked(s.clients[clientID])
+		} else {
+			s.resumeLocked(s.clients[clientID])
+		}
+	}
+
+	return clientIDs, nil
+}
+
+// pauseLocked stops delivery to the client and, with PauseReply, tells a poll that is already waiting
+func (s *NotificationServer) pauseLocked(entry *notificationClientEntry) {
+
+	if entry.paused {
+		return
+	}
+	entry.paused = true
+
+	if s.PauseReply && entry.listener != nil {
+		s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Paused"), MessageType: PAUSED})
+	}
+}
+
+// resumeLocked lifts the pause and hands the backlog to a poll that was held meanwhile
+func (s *NotificationServer) resumeLocked(entry *notificationClientEntry) {
+
+	if !entry.paused {
+		return
+	}
+	entry.paused = false
+
+	if entry.listener != nil {
+		s.processBacklogLocked(entry)
+	}
+}
+
+// setPaused pauses or resumes the clients of the request and returns their IDs
+func (s *NotificationServer) setPaused(request NotificationPauseRequest, paused bool) ([]string, error) {
+
+	if (request.ClientID == "") == (request.Selector == "") {
+		return nil, fmt.Errorf("%w: exactly one of ClientID and Selector must be set", ErrInvalidQuery)
+	}
+
+	if request.Selector != "" {
+		clientIDs, err := s.setPausedWhere(request.Selector, paused)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		return clientIDs, nil
+	}
+
+	var err error
+	if paused {
+		err = s.PauseClient(request.ClientID)
+	} else {
+		err = s.ResumeClient(request.ClientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{request.ClientID}, nil
+}
+
+// Pause pauses delivery to the clients of the request. The reply holds their IDs. It requires PermissionAdmin.
+func (t *NotificationService) Pause(request NotificationPauseRequest, reply *[]string) error {
+	return t.setPaused(request, true, reply)
+}
+
+// Resume resumes delivery to the clients of the request. The reply holds their IDs. It requires PermissionAdmin.
+func (t *NotificationService) Resume(request NotificationPauseRequest, reply *[]string) error {
+	return t.setPaused(request, false, reply)
+}
+
+func (t *NotificationService) setPaused(request NotificationPauseRequest, paused bool, reply *[]string) error {
+
+	if err := t.server.allowAdmin(t.session); err != nil {
+		return err
+	}
+
+	clientIDs, err := t.server.setPaused(request, paused)
+	if err != nil {
+		return err
+	}
+	*reply = clientIDs
+
+	return nil
+}
+
+func (s *NotificationServer) adminSetPaused(paused bool) func(ctx context.Context, request NotificationPauseRequest) (any, error) {
+	return func(ctx context.Context, request NotificationPauseRequest) (any, error) {
+		clientIDs, err := s.setPaused(request, paused)
+		return map[string][]string{"clients": clientIDs}, err
+	}
+}
@@ -0,0 +1,95 @@
+package qsutils
+
+import (
+	"testing"
+	"time"
+)
+
+// pollInBackground starts a poll for the client and returns the channel its reply arrives on
+func pollInBackground(s *NotificationServer, client NotificationClient) <-chan NotificationServiceMessage {
+	replies := make(chan NotificationServiceMessage, 1)
+	go func() { replies <- s.listen(client) }()
+	// give the poll time to register before the test acts on it
+	time.Sleep(20 * time.Millisecond)
+	return replies
+}
+
+func TestPausedClientReceivesBacklogOnResume(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PauseClient("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMessageToClient("a", NotificationServiceMessage{Message: getGobFromString("held"), MessageType: MESSAGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := pollInBackground(s, NotificationClient{ClientID: "a"})
+	select {
+	case message := <-replies:
+		t.Fatalf("paused client was sent %s", MessageTypeName(message.MessageType))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := s.ResumeClient("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-replies:
+		if getStringFromGob(message.Message) != "held" {
+			t.Fatalf("poll after ResumeClient returned %q, want the held message", getStringFromGob(message.Message))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("held poll not answered after ResumeClient")
+	}
+}
+
+func TestPauseReplyAnswersWaitingPoll(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.PauseReply = true
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := pollInBackground(s, NotificationClient{ClientID: "a"})
+	if err := s.PauseClient("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-replies:
+		if message.MessageType != PAUSED {
+			t.Fatalf("waiting poll answered with %s, want PAUSED", MessageTypeName(message.MessageType))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting poll not answered by PauseClient")
+	}
+}
+
+func TestPauseWhereSelectsClients(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	for clientID, site := range map[string]string{"a": "lobby", "b": "gate"} {
+		if _, err := s.Register(NotificationClient{ClientID: clientID, Properties: map[string]any{"site": site}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clientIDs, err := s.PauseWhere(`site == "lobby"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientIDs) != 1 || clientIDs[0] != "a" || !s.Paused("a") || s.Paused("b") {
+		t.Fatalf("PauseWhere paused %v", clientIDs)
+	}
+
+	if _, err := s.ResumeWhere(`site == "lobby"`); err != nil {
+		t.Fatal(err)
+	}
+	if s.Paused("a") {
+		t.Fatal("client still paused after ResumeWhere")
+	}
+}
@@ -0,0 +1,204 @@
+package qsutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// NotificationHandler handles a single message received from the notification server
+type NotificationHandler interface {
+	HandleNotification(ctx context.Context, message NotificationServiceMessage) error
+}
+
+// NotificationHandlerFunc adapts an ordinary function to a NotificationHandler
+type NotificationHandlerFunc func(ctx context.Context, message NotificationServiceMessage) error
+
+func (f NotificationHandlerFunc) HandleNotification(ctx context.Context, message NotificationServiceMessage) error {
+	return f(ctx, message)
+}
+
+// NotificationMiddleware wraps a handler with behaviour shared by every message type
+type NotificationMiddleware func(next NotificationHandler) NotificationHandler
+
+// NotificationSource is a connection to the notification server that a NotificationRouter can
+// drive. NotificationListener and WebSocketListener are sources.
+type NotificationSource interface {
+	// Next blocks until the next message for the client arrives
+	Next(ctx context.Context) (NotificationServiceMessage, error)
+
+	// Ack acknowledges messages, doing nothing if the client does not acknowledge messages
+	Ack(ctx context.Context, messageIDs ...uint64) error
+}
+
+// NotificationRouter dispatches the messages received from a NotificationSource to the handler
+// registered for their MessageType. Messages without a handler go to the default handler, or
+// are dropped if there is none.
+type NotificationRouter struct {
+	Listener NotificationSource
+
+	// ErrorHandler is called with every error returned by a handler. If nil the error is logged.
+	ErrorHandler func(message NotificationServiceMessage, err error)
+
+	mu             sync.RWMutex
+	handlers       map[int]NotificationHandler
+	defaultHandler NotificationHandler
+	middleware     []NotificationMiddleware
+}
+
+// NewNotificationRouter creates a router that receives messages from the listener
+func NewNotificationRouter(listener NotificationSource) *NotificationRouter {
+	return &NotificationRouter{
+		Listener: listener,
+		handlers: make(map[int]NotificationHandler),
+	}
+}
+
+// Handle registers the handler for a message type, replacing any earlier one
+func (r *NotificationRouter) Handle(messageType int, handler NotificationHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[messageType] = handler
+}
+
+// HandleFunc registers the function as the handler for a message type
+func (r *NotificationRouter) HandleFunc(messageType int, handler func(ctx context.Context, message NotificationServiceMessage) error) {
+	r.Handle(messageType, NotificationHandlerFunc(handler))
+}
+
+// Default registers the handler for message types that have no handler of their own
+func (r *NotificationRouter) Default(handler NotificationHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.defaultHandler = handler
+}
+
+// Use appends middleware to the chain. The first middleware added is the outermost.
+func (r *NotificationRouter) Use(middleware ...NotificationMiddleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Dispatch runs the message through the middleware chain and the matching handler
+func (r *NotificationRouter) Dispatch(ctx context.Context, message NotificationServiceMessage) error {
+
+	r.mu.RLock()
+	handler, ok := r.handlers[message.MessageType]
+	if !ok {
+		handler = r.defaultHandler
+	}
+	middleware := r.middleware
+	r.mu.RUnlock()
+
+	if handler == nil {
+		return nil
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler.HandleNotification(ctx, message)
+}
+
+// Run drives the long-poll loop, dispatching every message until the context is done or the
+// listener fails. Handler errors are passed to ErrorHandler and do not stop the loop. If the
+// listener acknowledges messages, a message is acknowledged once its handler returns without
+// error, so a failed message is redelivered.
+func (r *NotificationRouter) Run(ctx context.Context) error {
+
+	for {
+		message, err := r.Listener.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := r.Dispatch(ctx, message); err != nil {
+			r.handleError(message, err)
+			continue
+		}
+
+		if message.ID != 0 {
+			if err := r.Listener.Ack(ctx, message.ID); err != nil {
+				r.handleError(message, err)
+			}
+		}
+	}
+}
+
+func (r *NotificationRouter) handleError(message NotificationServiceMessage, err error) {
+	if r.ErrorHandler != nil {
+		r.ErrorHandler(message, err)
+	} else {
+		log.Printf("notification handler error for %s message: %v", MessageTypeName(message.MessageType), err)
+	}
+}
+
+// LoggingMiddleware logs every message passing through the router. If logger is nil the standard logger is used.
+func LoggingMiddleware(logger *log.Logger) NotificationMiddleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next NotificationHandler) NotificationHandler {
+		return NotificationHandlerFunc(func(ctx context.Context, message NotificationServiceMessage) error {
+			logger.Printf("notification received: %s (%d bytes)", MessageTypeName(message.MessageType), len(message.Message))
+			return next.HandleNotification(ctx, message)
+		})
+	}
+}
+
+// RecoveryMiddleware turns a panic in a handler into an error so that the poll loop keeps running
+func RecoveryMiddleware() NotificationMiddleware {
+	return func(next NotificationHandler) NotificationHandler {
+		return NotificationHandlerFunc(func(ctx context.Context, message NotificationServiceMessage) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("panic in notification handler: %v\n%s", p, debug.Stack())
+				}
+			}()
+			return next.HandleNotification(ctx, message)
+		})
+	}
+}
+
+type decodedPayloadKey struct{}
+
+// DecodingMiddleware decodes the message body before the handler runs and makes the result
+// available through DecodedPayload. If decode is nil the body is decoded by the codec named by
+// its ContentType: gob bodies as strings, like the bodies the server sends itself, and other
+// bodies into an any, such as a map for JSON or a []byte for raw bodies. A decoding error is
+// returned without calling the handler.
+func DecodingMiddleware(decode func(message NotificationServiceMessage) (any, error)) NotificationMiddleware {
+	if decode == nil {
+		decode = decodeByContentType
+	}
+	return func(next NotificationHandler) NotificationHandler {
+		return NotificationHandlerFunc(func(ctx context.Context, message NotificationServiceMessage) error {
+			payload, err := decode(message)
+			if err != nil {
+				return err
+			}
+			return next.HandleNotification(context.WithValue(ctx, decodedPayloadKey{}, payload), message)
+		})
+	}
+}
+
+// DecodedPayload returns the payload decoded by DecodingMiddleware, or nil if there is none
+func DecodedPayload(ctx context.Context) any {
+	return ctx.Value(decodedPayloadKey{})
+}
+
+func decodeByContentType(message NotificationServiceMessage) (any, error) {
+	switch message.ContentType {
+	case "", ContentTypeGob:
+		if len(message.Message) == 0 {
+			return "", nil
+		}
+		return Decode[string](message)
+	default:
+		return Decode[any](message)
+	}
+}
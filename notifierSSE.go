@@ -0,0 +1,219 @@
+package qsutils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// EnableSSE serves the notification stream as Server-Sent Events at path, for read-only
+// consumers such as status pages and scripts. A consumer opens the stream with a GET; the query
+// parameters are the registration of the client:
+//
+//	client_id      the ID of the client, issued by the server if missing
+//	topic          a topic to subscribe to, repeated or comma separated
+//	last_event_id  as the Last-Event-ID header, for consumers that cannot set headers
+//	access_token   as a bearer token in the Authorization header, for a server with an Authenticator
+//
+// Every other parameter is a client property for selectors, read as a number or boolean where
+// it parses as one. The stream starts with a "registered" event carrying the ClientID, which
+// has to be passed back as client_id to resume the same backlog.
+//
+// Each message is sent as an event named after its message type, with the message ID as the
+// event ID and the JSON NotificationServiceMessage as data. Events the server generates itself,
+// such as "registered" and "disabled", carry plain text with ContentTypeText. A message counts
+// as acknowledged once it has been flushed to the connection; a message that could not be
+// written is sent again on the next connection unless its ID is given as Last-Event-ID.
+func (s *NotificationServer) EnableSSE(path string) {
+	s.mux.HandleFunc(path, s.serveSSE)
+}
+
+func (s *NotificationServer) serveSSE(w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "405 must GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, lastEventID, err := sseRegistration(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.requestSession(req)
+	if err == nil {
+		client, err = session.authorizeClient(client)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), apiErrorStatus(err))
+		return
+	}
+
+	clientID, err := s.Register(client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	client.ClientID = clientID
+
+	// subscriptions are only taken from the registration, as for WebSocket clients
+	client.Topics = nil
+
+	// the consumer has the message it saw last, whether or not its flush was confirmed here
+	if lastEventID != 0 {
+		s.Ack(clientID, lastEventID)
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	registered := textControlMessage("Registered", REGISTERED, clientID)
+	if writeSSEEvent(w, registered) != nil || rc.Flush() != nil {
+		return
+	}
+
+	// the disabled loop below holds no poll, so Shutdown has to end the stream itself
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// the first poll of a connection redelivers what the previous one could not write
+	streaming := false
+
+	for {
+		if s.disabled.Load() {
+			disabled := textControlMessage("Disabled", DISABLED, clientID)
+			if writeSSEEvent(w, disabled) != nil || rc.Flush() != nil || sleepContext(ctx, s.RefreshInterval) != nil {
+				return
+			}
+			continue
+		}
+
+		message, err := s.listenContext(ctx, client, streaming)
+		if err != nil {
+			return
+		}
+		streaming = true
+
+		switch {
+		case message.MessageType == REFRESHTIMER && getStringFromGob(message.Message) == supersededReason:
+			return
+		case message.MessageType == REFRESHTIMER:
+			// a comment keeps proxies from timing out the idle stream
+			_, err = io.WriteString(w, ": refresh\n\n")
+		default:
+			err = writeSSEEvent(w, textControl(message))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+
+		if message.ID != 0 {
+			s.Ack(clientID, message.ID)
+		}
+
+		if message.MessageType == DISCONNECTED {
+			return
+		}
+	}
+}
+
+// sseRegistration reads the client registration and Last-Event-ID from the request
+func sseRegistration(req *http.Request) (NotificationClient, uint64, error) {
+
+	query := req.URL.Query()
+
+	client := NotificationClient{
+		ClientID:    query.Get("client_id"),
+		Acknowledge: true,
+	}
+
+	for _, value := range query["topic"] {
+		for _, topic := range strings.Split(value, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				client.Topics = append(client.Topics, topic)
+			}
+		}
+	}
+
+	client.Properties = sseProperties(query)
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+	if lastEventID == "" {
+		return client, 0, nil
+	}
+	id, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return client, 0, errors.New("invalid Last-Event-ID: " + lastEventID)
+	}
+
+	return client, id, nil
+}
+
+// sseProperties turns the query parameters that are not part of the registration into client properties
+func sseProperties(query url.Values) map[string]any {
+
+	properties := make(map[string]any)
+	for name, values := range query {
+		switch name {
+		case "client_id", "topic", "last_event_id", "access_token":
+			continue
+		}
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if value == "true" || value == "false" {
+			properties[name] = value == "true"
+		} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+			properties[name] = f
+		} else {
+			properties[name] = value
+		}
+	}
+
+	if len(properties) == 0 {
+		return nil
+	}
+	return properties
+}
+
+func writeSSEEvent(w io.Writer, message NotificationServiceMessage) error {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if message.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", message.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", strings.ToLower(MessageTypeName(message.MessageType)), data)
+
+	return err
+}
@@ -0,0 +1,54 @@
+package qsutils
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDisabledSSEStreamEndsOnShutdown(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.RefreshInterval = time.Hour
+	s.Disable()
+
+	server := httptest.NewServer(http.HandlerFunc(s.serveSSE))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?client_id=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "event: disabled\n" {
+			break
+		}
+	}
+
+	s.Shutdown(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("disabled stream still open after Shutdown")
+	}
+}
@@ -0,0 +1,220 @@
+package qsutils
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// ScheduledMessage is a message waiting for its delivery time. Exactly one of ClientID and Topic is set.
+type ScheduledMessage struct {
+	ClientID  string
+	Topic     string
+	DeliverAt time.Time
+	Message   NotificationServiceMessage
+}
+
+// ScheduleStore is implemented by a BacklogStore that can also keep scheduled messages, so that
+// they survive a restart of the server
+type ScheduleStore interface {
+	AppendScheduled(scheduled ScheduledMessage) error
+	RemoveScheduled(messageID uint64) error
+	LoadScheduled() ([]ScheduledMessage, error)
+}
+
+// SendMessageAt delivers the message to the client at the given time. It returns the ID of the
+// message, which can be passed to CancelScheduled. The client must be registered. Its scheduled
+// messages are dropped if it is disconnected or expires before they fall due; those restored from
+// a durable store after a restart wait in its backlog until it polls again.
+func (s *NotificationServer) SendMessageAt(clientID string, message NotificationServiceMessage, at time.Time) (uint64, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrServerClosed
+	}
+	if _, ok := s.clients[clientID]; !ok {
+		return 0, ErrUnknownClient
+	}
+
+	return s.scheduleLocked(ScheduledMessage{ClientID: clientID, DeliverAt: at, Message: message})
+}
+
+// SendMessageAfter delivers the message to the client once the duration has passed
+func (s *NotificationServer) SendMessageAfter(clientID string, message NotificationServiceMessage, d time.Duration) (uint64, error) {
+	return s.SendMessageAt(clientID, message, time.Now().Add(d))
+}
+
+// SendToTopicAt delivers the message at the given time to the clients subscribed to the topic at that time
+func (s *NotificationServer) SendToTopicAt(topic string, message NotificationServiceMessage, at time.Time) (uint64, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrServerClosed
+	}
+
+	return s.scheduleLocked(ScheduledMessage{Topic: topic, DeliverAt: at, Message: message})
+}
+
+// SendToTopicAfter delivers the message to the subscribers of the topic once the duration has passed
+func (s *NotificationServer) SendToTopicAfter(topic string, message NotificationServiceMessage, d time.Duration) (uint64, error) {
+	return s.SendToTopicAt(topic, message, time.Now().Add(d))
+}
+
+// CancelScheduled removes a scheduled message that has not been delivered yet. It reports whether the message was found.
+func (s *NotificationServer) CancelScheduled(messageID uint64) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.schedule.Front(); e != nil; e = e.Next() {
+		if e.Value.(ScheduledMessage).Message.ID == messageID {
+			s.schedule.Remove(e)
+			s.unpersistScheduledLocked(messageID)
+			s.armScheduleLocked()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scheduled returns the messages waiting for their delivery time, earliest first
+func (s *NotificationServer) Scheduled() []ScheduledMessage {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled := make([]ScheduledMessage, 0, s.schedule.Len())
+	for e := s.schedule.Back(); e != nil; e = e.Prev() {
+		scheduled = append(scheduled, e.Value.(ScheduledMessage))
+	}
+
+	return scheduled
+}
+
+func (s *NotificationServer) scheduleLocked(scheduled ScheduledMessage) (uint64, error) {
+
+	s.assignIDLocked(&scheduled.Message)
+
+	if store, ok := s.BacklogStore.(ScheduleStore); ok {
+		if err := store.AppendScheduled(scheduled); err != nil {
+			return 0, err
+		}
+	}
+
+	s.insertScheduledLocked(scheduled)
+	s.armScheduleLocked()
+
+	return scheduled.Message.ID, nil
+}
+
+// insertScheduledLocked adds the message to the schedule. The list is kept latest first, so the
+// next message due is always at the back.
+func (s *NotificationServer) insertScheduledLocked(scheduled ScheduledMessage) {
+	s.schedule.InsertByDateTime(scheduled, scheduled.DeliverAt)
+}
+
+// armScheduleLocked sets the schedule timer for the earliest message
+func (s *NotificationServer) armScheduleLocked() {
+
+	if s.scheduleTimer != nil {
+		s.scheduleTimer.Stop()
+		s.scheduleTimer = nil
+	}
+
+	next := s.schedule.Back()
+	if next == nil || s.closed {
+		return
+	}
+
+	s.scheduleTimer = time.AfterFunc(time.Until(next.DateTime), s.deliverScheduled)
+}
+
+// deliverScheduled sends every message that has become due
+func (s *NotificationServer) deliverScheduled() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	now := time.Now()
+	var due []ScheduledMessage
+	for e := s.schedule.Back(); e != nil && !e.DateTime.After(now); e = s.schedule.Back() {
+		due = append(due, s.schedule.Remove(e).(ScheduledMessage))
+	}
+
+	// messages due at the same time go out in the order they were scheduled
+	sort.Slice(due, func(i, j int) bool { return due[i].Message.ID < due[j].Message.ID })
+
+	// a client that left took its schedule with it, so an unknown client has yet to come back after a restart
+	for _, scheduled := range due {
+		if scheduled.Topic != "" {
+			if err := s.sendToTopicLocked(scheduled.Topic, scheduled.Message); err != nil {
+				log.Printf("scheduled message %d for topic %s not delivered: %v", scheduled.Message.ID, scheduled.Topic, err)
+			}
+		} else if err := s.sendToEntryLocked(s.clientEntryLocked(scheduled.ClientID), scheduled.Message); err != nil {
+			log.Printf("scheduled message %d for client %s not delivered: %v", scheduled.Message.ID, scheduled.ClientID, err)
+		}
+		s.unpersistScheduledLocked(scheduled.Message.ID)
+	}
+
+	s.armScheduleLocked()
+}
+
+// loadScheduledLocked restores the stored schedule, if the backlog store keeps one
+func (s *NotificationServer) loadScheduledLocked() error {
+
+	store, ok := s.BacklogStore.(ScheduleStore)
+	if !ok {
+		return nil
+	}
+
+	scheduled, err := store.LoadScheduled()
+	if err != nil {
+		return err
+	}
+
+	for _, sm := range scheduled {
+		s.insertScheduledLocked(sm)
+		s.lastMessageID = max(s.lastMessageID, sm.Message.ID)
+	}
+	s.armScheduleLocked()
+
+	return nil
+}
+
+// dropScheduledLocked discards the messages scheduled for a client that has left the registry
+func (s *NotificationServer) dropScheduledLocked(clientID string) {
+
+	dropped := false
+	for e := s.schedule.Front(); e != nil; {
+		next := e.Next()
+		if scheduled := e.Value.(ScheduledMessage); scheduled.ClientID == clientID {
+			s.schedule.Remove(e)
+			s.unpersistScheduledLocked(scheduled.Message.ID)
+			dropped = true
+		}
+		e = next
+	}
+
+	if dropped {
+		s.armScheduleLocked()
+	}
+}
+
+func (s *NotificationServer) unpersistScheduledLocked(messageID uint64) {
+	store, ok := s.BacklogStore.(ScheduleStore)
+	if !ok {
+		return
+	}
+	if err := store.RemoveScheduled(messageID); err != nil {
+		log.Printf("backlog store: cannot remove scheduled message %d: %v", messageID, err)
+	}
+}
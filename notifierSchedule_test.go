@@ -0,0 +1,86 @@
+package qsutils
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduledMessageDroppedOnDisconnect(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SendMessageAfter("a", NotificationServiceMessage{Message: getGobFromString("later")}, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	s.Disconnect("a")
+
+	if scheduled := s.Scheduled(); len(scheduled) != 0 {
+		t.Fatalf("schedule holds %d messages after Disconnect, want none", len(scheduled))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := s.Client("a"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("Client after the due time returned %v, want ErrUnknownClient", err)
+	}
+}
+
+func TestSendMessageAtUnknownClient(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+
+	if _, err := s.SendMessageAfter("nobody", NotificationServiceMessage{}, time.Minute); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("SendMessageAfter returned %v, want ErrUnknownClient", err)
+	}
+}
+
+func TestScheduledMessageRestoredAfterRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "backlog")
+
+	store, err := OpenFileBacklogStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewNotificationServer(nil)
+	s.BacklogStore = store
+	if _, err := s.Register(NotificationClient{ClientID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.SendMessageAfter("a", NotificationServiceMessage{Message: getGobFromString("later")}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown(context.Background())
+	store.Close()
+
+	store, err = OpenFileBacklogStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s = NewNotificationServer(nil)
+	s.BacklogStore = store
+	s.mu.Lock()
+	err = s.loadStoreLocked()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	backlog, err := s.Backlog("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].ID != id {
+		t.Fatalf("backlog after restart is %v, want message %d", backlog, id)
+	}
+}
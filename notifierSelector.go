@@ -0,0 +1,523 @@
+package qsutils
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ClientSelector is a compiled expression over the Properties of a client, for example
+//
+//	role == "gate-display" && terminal in ["T1", "T2"]
+//
+// Operands are property names, quoted strings, numbers, true and false. The operators are
+// == != < <= > >= in, "not in", && || and !, with parentheses for grouping. A property name on
+// its own is true if the property is set to anything other than false, zero or "". A comparison
+// involving a property the client does not have is false, and so are in and "not in". Values of
+// different types are never equal, so "1" == 1 is false.
+type ClientSelector struct {
+	source string
+	root   selectorNode
+}
+
+// ParseClientSelector compiles the selector expression
+func ParseClientSelector(expression string) (*ClientSelector, error) {
+
+	tokens, err := tokenizeSelector(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &selectorParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != selectorEOF {
+		return nil, fmt.Errorf("selector: unexpected %q at offset %d", tok.text, tok.pos)
+	}
+
+	return &ClientSelector{source: expression, root: root}, nil
+}
+
+// Match reports whether the properties satisfy the selector
+func (c *ClientSelector) Match(properties map[string]any) bool {
+	return c.root.eval(properties)
+}
+
+func (c *ClientSelector) String() string {
+	return c.source
+}
+
+// MatchClients returns the IDs of the clients whose properties satisfy the selector expression
+func (s *NotificationServer) MatchClients(selector string) ([]string, error) {
+
+	compiled, err := ParseClientSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.MatchClientsFunc(compiled.Match), nil
+}
+
+// MatchClientsFunc returns the IDs of the clients whose properties satisfy the predicate
+func (s *NotificationServer) MatchClientsFunc(predicate func(properties map[string]any) bool) []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientIDs := s.matchClientsLocked(predicate)
+	sort.Strings(clientIDs)
+
+	return clientIDs
+}
+
+// SendMessageWhere sends the message to every client whose properties satisfy the selector expression
+func (s *NotificationServer) SendMessageWhere(selector string, message NotificationServiceMessage) error {
+
+	compiled, err := ParseClientSelector(selector)
+	if err != nil {
+		return err
+	}
+
+	return s.SendMessageWhereFunc(compiled.Match, message)
+}
+
+// SendMessageWhereFunc sends the message to every client whose properties satisfy the predicate
+func (s *NotificationServer) SendMessageWhereFunc(predicate func(properties map[string]any) bool, message NotificationServiceMessage) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	s.assignIDLocked(&message)
+
+	return s.sendMessageToClientsLocked(s.matchClientsLocked(predicate), message)
+}
+
+func (s *NotificationServer) matchClientsLocked(predicate func(properties map[string]any) bool) []string {
+	var clientIDs []string
+	for clientID, entry := range s.clients {
+		if predicate(entry.info.Properties) {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	return clientIDs
+}
+
+type selectorTokenKind int
+
+const (
+	selectorEOF selectorTokenKind = iota
+	selectorIdent
+	selectorString
+	selectorNumber
+	selectorOperator
+)
+
+type selectorToken struct {
+	kind selectorTokenKind
+	text string
+	pos  int
+}
+
+func tokenizeSelector(expression string) ([]selectorToken, error) {
+
+	var tokens []selectorToken
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("selector: unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, selectorToken{kind: selectorString, text: sb.String(), pos: start})
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, selectorToken{kind: selectorNumber, text: string(runes[start:i]), pos: start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("_.-", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, selectorToken{kind: selectorIdent, text: string(runes[start:i]), pos: start})
+
+		default:
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "==", "!=", "<=", ">=", "&&", "||":
+				tokens = append(tokens, selectorToken{kind: selectorOperator, text: two, pos: start})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("<>!()[],", r) {
+				return nil, fmt.Errorf("selector: unexpected character %q at offset %d", r, start)
+			}
+			tokens = append(tokens, selectorToken{kind: selectorOperator, text: string(r), pos: start})
+			i++
+		}
+	}
+
+	return append(tokens, selectorToken{kind: selectorEOF, pos: len(runes)}), nil
+}
+
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.pos]
+}
+
+func (p *selectorParser) next() selectorToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != selectorEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *selectorParser) accept(text string) bool {
+	if tok := p.peek(); tok.kind == selectorOperator && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return fmt.Errorf("selector: expected %q at offset %d", text, tok.pos)
+	}
+	return nil
+}
+
+func (p *selectorParser) parseOr() (selectorNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = selectorOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (selectorNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = selectorAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseUnary() (selectorNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return selectorNot{operand}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *selectorParser) parseComparison() (selectorNode, error) {
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	switch {
+	case tok.kind == selectorOperator && isSelectorComparison(tok.text):
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return selectorCompare{op: tok.text, left: left, right: right}, nil
+
+	case tok.kind == selectorIdent && (tok.text == "in" || tok.text == "not"):
+		p.next()
+		negate := tok.text == "not"
+		if negate {
+			if in := p.next(); in.kind != selectorIdent || in.text != "in" {
+				return nil, fmt.Errorf("selector: expected \"in\" at offset %d", in.pos)
+			}
+		}
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return selectorIn{value: left, list: list, negate: negate}, nil
+	}
+
+	return selectorTruthy{left}, nil
+}
+
+func isSelectorComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) parseList() ([]selectorOperand, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var list []selectorOperand
+	if p.accept("]") {
+		return list, nil
+	}
+	for {
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, operand)
+		if p.accept("]") {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *selectorParser) parseOperand() (selectorOperand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case selectorString:
+		return selectorOperand{value: tok.text, literal: true}, nil
+	case selectorNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return selectorOperand{}, fmt.Errorf("selector: bad number %q at offset %d", tok.text, tok.pos)
+		}
+		return selectorOperand{value: f, literal: true}, nil
+	case selectorIdent:
+		switch tok.text {
+		case "true":
+			return selectorOperand{value: true, literal: true}, nil
+		case "false":
+			return selectorOperand{value: false, literal: true}, nil
+		case "in", "not":
+			return selectorOperand{}, fmt.Errorf("selector: unexpected %q at offset %d", tok.text, tok.pos)
+		}
+		return selectorOperand{property: tok.text}, nil
+	case selectorEOF:
+		return selectorOperand{}, fmt.Errorf("selector: unexpected end of expression")
+	default:
+		return selectorOperand{}, fmt.Errorf("selector: unexpected %q at offset %d", tok.text, tok.pos)
+	}
+}
+
+type selectorNode interface {
+	eval(properties map[string]any) bool
+}
+
+// selectorOperand is either a literal value or a reference to a client property
+type selectorOperand struct {
+	property string
+	value    any
+	literal  bool
+}
+
+func (o selectorOperand) resolve(properties map[string]any) (any, bool) {
+	if o.literal {
+		return o.value, true
+	}
+	v, ok := properties[o.property]
+	return v, ok
+}
+
+type selectorOr struct{ left, right selectorNode }
+type selectorAnd struct{ left, right selectorNode }
+type selectorNot struct{ operand selectorNode }
+type selectorTruthy struct{ operand selectorOperand }
+
+type selectorCompare struct {
+	op          string
+	left, right selectorOperand
+}
+
+type selectorIn struct {
+	value  selectorOperand
+	list   []selectorOperand
+	negate bool // not in
+}
+
+func (n selectorOr) eval(properties map[string]any) bool {
+	return n.left.eval(properties) || n.right.eval(properties)
+}
+
+func (n selectorAnd) eval(properties map[string]any) bool {
+	return n.left.eval(properties) && n.right.eval(properties)
+}
+
+func (n selectorNot) eval(properties map[string]any) bool {
+	return !n.operand.eval(properties)
+}
+
+func (n selectorTruthy) eval(properties map[string]any) bool {
+	v, ok := n.operand.resolve(properties)
+	if !ok || v == nil {
+		return false
+	}
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		return t != ""
+	}
+	if f, ok := selectorNumeric(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+func (n selectorCompare) eval(properties map[string]any) bool {
+	left, ok := n.left.resolve(properties)
+	if !ok {
+		return false
+	}
+	right, ok := n.right.resolve(properties)
+	if !ok {
+		return false
+	}
+
+	cmp, ordered := selectorCompareValues(left, right)
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return ordered && cmp < 0
+	case "<=":
+		return ordered && cmp <= 0
+	case ">":
+		return ordered && cmp > 0
+	case ">=":
+		return ordered && cmp >= 0
+	}
+	return false
+}
+
+func (n selectorIn) eval(properties map[string]any) bool {
+	v, ok := n.value.resolve(properties)
+	if !ok {
+		return false
+	}
+	for _, item := range n.list {
+		candidate, ok := item.resolve(properties)
+		if !ok {
+			continue
+		}
+		if cmp, _ := selectorCompareValues(v, candidate); cmp == 0 {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// selectorCompareValues compares two values, numerically if both are numbers and as strings
+// if both are strings. Booleans are only equal or not, and values of different types are never
+// equal. ordered is false when the values only support equality.
+func selectorCompareValues(a, b any) (cmp int, ordered bool) {
+
+	if fa, ok := selectorNumeric(a); ok {
+		if fb, ok := selectorNumeric(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb), true
+		}
+	}
+
+	if ba, ok := a.(bool); ok {
+		if bb, ok := b.(bool); ok && ba == bb {
+			return 0, false
+		}
+	}
+
+	return 1, false
+}
+
+func selectorNumeric(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,52 @@
+package qsutils
+
+import "testing"
+
+func TestClientSelectorMatch(t *testing.T) {
+
+	properties := map[string]any{
+		"site":     "lobby",
+		"terminal": "T1",
+		"floor":    2,
+		"count":    "1",
+		"active":   true,
+	}
+
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{`site == "lobby"`, true},
+		{`terminal in ["T1", "T2"]`, true},
+		{`terminal not in ["T1", "T2"]`, false},
+		{`terminal not in ["T3"]`, true},
+
+		// a missing property satisfies neither in nor not in
+		{`gate in ["A1"]`, false},
+		{`gate not in ["A1"]`, false},
+		{`!(gate in ["A1"])`, true},
+
+		// values of different types are never equal
+		{`count == 1`, false},
+		{`count != 1`, true},
+		{`count == "1"`, true},
+		{`floor == "2"`, false},
+		{`floor == 2`, true},
+		{`floor in ["2"]`, false},
+		{`floor not in ["2"]`, true},
+		{`active == "true"`, false},
+		{`active == true`, true},
+		{`active in [1]`, false},
+	}
+
+	for _, test := range tests {
+		selector, err := ParseClientSelector(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+		if got := selector.Match(properties); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
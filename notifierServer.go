@@ -1,208 +1,826 @@
 package qsutils
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/gob"
 )
 
-var listenerMap map[int]chan NotificationServiceMessage
-var backlogMap map[int]*List
-var clientPropertyMap map[int]map[string]any
-var refreshTimerMap map[int]*time.Timer
-var clientRegisteredChan chan NotificationClient = make(chan NotificationClient)
-
-// type NotificationServiceMessage struct {
-// 	Message     []byte
-// 	MessageType int
-// }
-
-// type NotificationClient struct {
-// 	ProcessID  int
-// 	Properties map[string]any
-// }
-
-// const (
-// 	REGISTERED         = iota
-// 	DISABLED           = iota
-// 	MESSAGE            = iota
-// 	DISCONNECTED       = iota
-// 	CLEARBACKLOG       = iota
-// 	BROADCASTMESSAGE   = iota
-// 	OPERATIONALMESSAGE = iota
-// 	TIMEOUT            = iota
-// 	REFRESHTIMER       = iota
-// )
+const (
+	defaultRefreshInterval     = 13 * time.Second
+	defaultAckTimeout          = 30 * time.Second
+	defaultMaxDeliveryAttempts = 5
+	defaultMaxBatchMessages    = 100
+	defaultMaxBatchBytes       = 1 << 20
+	defaultMaxPollTimeout      = 60 * time.Second
+	minPollTimeout             = time.Second
+)
+
+// supersededReason is the body of the REFRESHTIMER message that releases a poll replaced by a newer one
+const supersededReason = "Superseded"
+
+var ErrUnknownClient = errors.New("unknown notification client")
+var ErrServerClosed = errors.New("notification server closed")
+
+// notificationClientEntry holds everything the server knows about a single client
+type notificationClientEntry struct {
+	info         NotificationClient
+	listener     chan NotificationServiceMessage // pending long-poll, nil while the client is between polls
+	backlog      *List
+	refreshTimer *time.Timer
+	topics       map[string]struct{}
+	backlogBytes int
+	inflight     map[uint64]*inflightMessage // delivered messages waiting for an acknowledgement
+	redeliveries int
+	lastSeen     time.Time
+	heartbeat    time.Duration // negotiated heartbeat interval, zero if the client never expires
+	expiryTimer  *time.Timer
+	expired      bool // missed its heartbeats and kept under ExpireRetainBacklog
+	registered   bool // the client has registered or polled, it was not only restored from the store or subscribed
+	paused       bool // messages are queued instead of delivered until the client is resumed
+}
+
+// stopRefreshTimer stops the refresh timer of the client if there is one
+func (c *notificationClientEntry) stopRefreshTimer() {
+	if c.refreshTimer != nil {
+		c.refreshTimer.Stop()
+		c.refreshTimer = nil
+	}
+}
 
+// NotificationServer owns the client registry of a single notification endpoint.
+// All of its methods are safe for concurrent use and several servers can run in one process.
+type NotificationServer struct {
+	mu      sync.Mutex
+	clients map[string]*notificationClientEntry
+	topics  map[string]map[string]struct{} // topic -> IDs of the subscribed clients
+
+	service    *NotificationService
+	disabled   atomic.Bool // if true, polls are answered with DISABLED instead of messages
+	rpcServer  *rpc.Server
+	mux        *http.ServeMux
+	httpServer *http.Server
+	eventSubs  map[*EventSubscription]struct{}
+
+	closed        bool
+	closing       chan struct{}         // closed by Shutdown, ends the streams that are not waiting on a poll
+	conns         map[net.Conn]struct{} // connections served outside the http.Server: hijacked RPC and WebSocket, and JSON-RPC
+	connWG        sync.WaitGroup
+	jsonListeners []net.Listener
+	storeLoaded   bool
+	lastMessageID uint64
+	reservedID    uint64 // the message IDs up to this one are recorded by a MessageIDStore
+	schedule      *List  // ScheduledMessage values ordered by delivery time, latest first
+	scheduleTimer *time.Timer
+	metrics       serverMetrics
+
+	// RefreshInterval is how long a long-poll is held before the client is sent a REFRESHTIMER message.
+	// It must be set before the server is started.
+	RefreshInterval time.Duration
+
+	// MaxPollTimeout caps the NotificationClient.PollTimeout a client may ask for, zero means no limit
+	MaxPollTimeout time.Duration
+
+	// ShutdownSink, if set, receives the undelivered backlog of every client during Shutdown
+	ShutdownSink BacklogSink
+
+	// AckTimeout is how long a client that acknowledges messages has to do so before the message is
+	// redelivered. Zero or less starts no timer: an unacknowledged message is only redelivered
+	// when the client polls again.
+	AckTimeout time.Duration
+
+	// MaxDeliveryAttempts is the number of deliveries of an unacknowledged message before it is
+	// given to DeadLetterHandler instead. Zero means no limit.
+	MaxDeliveryAttempts int
+
+	// DeadLetterHandler, if set, is called in its own goroutine with every message that ran out of delivery attempts
+	DeadLetterHandler func(clientID string, message NotificationServiceMessage)
+
+	// MaxBacklogMessages and MaxBacklogBytes limit the backlog of each client, zero means no limit.
+	// OverflowPolicy decides what happens when a message does not fit.
+	MaxBacklogMessages int
+	MaxBacklogBytes    int
+	OverflowPolicy     OverflowPolicy
+
+	// MaxBatchMessages and MaxBatchBytes cap what a client may ask for in NotificationService.ListenBatch
+	MaxBatchMessages int
+	MaxBatchBytes    int
+
+	// BacklogStore, if set, makes backlogs durable. It must be set before the server is started
+	// and is loaded by Serve. The server does not close it.
+	BacklogStore BacklogStore
+
+	// TLSConfig, if set, makes every endpoint of the server use TLS. Set ClientCAs and ClientAuth
+	// in it for mutual TLS. It must be set before the server is started.
+	TLSConfig *tls.Config
+
+	// ClientIDFromCertificate, if set, derives the ID of a client from its verified certificate,
+	// for example CertificateCommonName. A connection with such a certificate may then only act
+	// for that client.
+	ClientIDFromCertificate func(cert *x509.Certificate) string
+
+	// Authenticator, if set, requires every caller to present a token, in NotificationClient.Token,
+	// NotificationService.Authenticate or the Authorization header, and to hold the permissions of
+	// the operations it calls. It must be set before the server is started.
+	Authenticator Authenticator
+
+	// MetricsPerClient adds series labelled by client ID to the metrics endpoint. It is off by
+	// default, as every client then becomes a series of its own in the monitoring system.
+	MetricsPerClient bool
+
+	// HeartbeatInterval is how often a client that does not ask for an interval of its own must
+	// poll, register, acknowledge or call NotificationService.Heartbeat. A client that misses
+	// MissedHeartbeats of them in a row (3 if zero) expires and is dealt with by ExpiryPolicy.
+	// Zero, the default, lets such clients live forever. MaxHeartbeatInterval, if set, caps the
+	// interval a client may ask for.
+	HeartbeatInterval    time.Duration
+	MaxHeartbeatInterval time.Duration
+	MissedHeartbeats     int
+	ExpiryPolicy         ExpiryPolicy
+
+	// ExpirySink, if set, receives the undelivered backlog of every client expired under ExpirePurgeBacklog
+	ExpirySink BacklogSink
+
+	// PauseReply, if set, answers the polls of a paused client with PAUSED at once. By default
+	// they are held until the client is resumed or the refresh timer fires.
+	PauseReply bool
+}
+
+// NotificationService is the RPC interface of a NotificationServer. Connections that have to
+// be authenticated, or whose client certificate names the client, get a service of their own.
 type NotificationService struct {
-	disabled bool // if true, then no messages will be sent to the client
+	server       *NotificationServer
+	session      *clientSession // the caller on the connection, nil if there is nothing to check
+	plainControl bool           // control replies carry plain text instead of gob, for JSON-RPC
+}
+
+// controlReply gives the control messages of a JSON-RPC connection plain text bodies
+func (t *NotificationService) controlReply(message NotificationServiceMessage) NotificationServiceMessage {
+	if t.plainControl {
+		return textControl(message)
+	}
+	return message
 }
 
 func (t *NotificationService) Disable() {
-	t.disabled = true
+	t.server.Disable()
 }
 
 func (t *NotificationService) Enable() {
-	t.disabled = false
+	t.server.Enable()
 }
 
 func (t *NotificationService) Listen(client NotificationClient, reply *NotificationServiceMessage) error {
 
-	if t.disabled {
-		reply.Message = getGobFromString("Disabled")
-		reply.MessageType = DISABLED
+	if t.server.disabled.Load() {
+		*reply = t.controlReply(NotificationServiceMessage{Message: getGobFromString("Disabled"), MessageType: DISABLED})
 		return nil
 	}
 
-	var dispatcherChan chan NotificationServiceMessage
-	var clientProcessID int = client.ProcessID
-
-	//if the channel exists, then use it else create a new channel for the args and use it
-	if _, ok := listenerMap[clientProcessID]; ok {
-		dispatcherChan = listenerMap[clientProcessID]
-	} else {
-		dispatcherChan = make(chan NotificationServiceMessage)
+	client, err := t.authorizeClient(client)
+	if err != nil {
+		return err
 	}
 
-	go registerListner(dispatcherChan, client)
+	*reply = t.controlReply(t.server.listen(client))
+
+	return nil
+}
+
+// Register records the client without waiting for a message. If the client has no ClientID, one is issued.
+func (t *NotificationService) Register(client NotificationClient, reply *NotificationRegistration) error {
 
-	clientRegisteredChan <- client
+	client, err := t.authorizeClient(client)
+	if err != nil {
+		return err
+	}
 
-	message := <-dispatcherChan
-	*reply = message
+	clientID, err := t.server.Register(client)
+	if err != nil {
+		return err
+	}
+	reply.ClientID = clientID
+	reply.HeartbeatInterval = t.server.heartbeatInterval(client.HeartbeatInterval)
+	reply.RefreshInterval = t.server.RefreshInterval
+	if timeout, releaseType := t.server.pollTimeout(client.PollTimeout); releaseType == TIMEOUT {
+		reply.PollTimeout = timeout
+	}
 
 	return nil
 }
-func (t *NotificationService) ClearBacklog(clientProcessID int, reply *NotificationServiceMessage) error {
+func (t *NotificationService) ClearBacklog(clientID string, reply *NotificationServiceMessage) error {
+
+	clientID, err := t.clientID(clientID)
+	if err != nil {
+		return err
+	}
 
-	delete(backlogMap, clientProcessID)
+	t.server.ClearBacklog(clientID)
 
-	reply.Message = getGobFromString("Backlog Cleared")
-	reply.MessageType = CLEARBACKLOG
+	*reply = t.controlReply(NotificationServiceMessage{Message: getGobFromString("Backlog Cleared"), MessageType: CLEARBACKLOG})
 
 	return nil
 }
-func (t *NotificationService) Disconnect(clientProcessID int, reply *NotificationServiceMessage) error {
-
-	delete(listenerMap, clientProcessID)
-	delete(backlogMap, clientProcessID)
-	delete(clientPropertyMap, clientProcessID)
+func (t *NotificationService) Disconnect(clientID string, reply *NotificationServiceMessage) error {
 
-	if timer, ok := refreshTimerMap[clientProcessID]; ok {
-		timer.Stop()
+	clientID, err := t.clientID(clientID)
+	if err != nil {
+		return err
 	}
-	delete(refreshTimerMap, clientProcessID)
 
-	reply.Message = getGobFromString("Disconnected")
-	reply.MessageType = DISCONNECTED
+	t.server.Disconnect(clientID)
+
+	*reply = t.controlReply(NotificationServiceMessage{Message: getGobFromString("Disconnected"), MessageType: DISCONNECTED})
 
 	return nil
 }
 
+// registrationHandler receives the client of every registration and poll. SubscribeEvents tells
+// first registrations from repeated polls and reports the rest of the life of a client.
 type registrationHandler func(ch chan NotificationClient)
 
-func InitServer(protocol string, endpoint string, registrationHandler registrationHandler) {
+// NewNotificationServer creates a server with an empty client registry. The server does not accept
+// connections until Serve is called. registrationHandler may be nil.
+func NewNotificationServer(registrationHandler registrationHandler) *NotificationServer {
 
 	gob.Register(NotificationServiceMessage{})
 
-	ns := new(NotificationService) // create a new instance of the service
-	ns.disabled = false            // set the disabled flag to false
+	s := &NotificationServer{
+		clients:             make(map[string]*notificationClientEntry),
+		topics:              make(map[string]map[string]struct{}),
+		conns:               make(map[net.Conn]struct{}),
+		closing:             make(chan struct{}),
+		rpcServer:           rpc.NewServer(),
+		mux:                 http.NewServeMux(),
+		schedule:            NewList(),
+		RefreshInterval:     defaultRefreshInterval,
+		MaxPollTimeout:      defaultMaxPollTimeout,
+		AckTimeout:          defaultAckTimeout,
+		MaxDeliveryAttempts: defaultMaxDeliveryAttempts,
+		MaxBatchMessages:    defaultMaxBatchMessages,
+		MaxBatchBytes:       defaultMaxBatchBytes,
+	}
+	s.service = &NotificationService{server: s}
+
+	s.rpcServer.Register(s.service)
+	s.mux.HandleFunc(rpc.DefaultRPCPath, s.serveRPC)
 
-	gob.Register(NotificationServiceMessage{})
+	if registrationHandler != nil {
+		registrations := make(chan NotificationClient)
+		go forwardRegistrations(s.SubscribeEvents(0, ClientFirstRegistered, ClientRepolled), registrations)
+		go registrationHandler(registrations)
+	}
+
+	return s
+}
+
+// Serve starts accepting connections on the endpoint in the background
+func (s *NotificationServer) Serve(protocol string, endpoint string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.httpServer != nil {
+		return errors.New("notification server already started")
+	}
+
+	if err := s.loadStoreLocked(); err != nil {
+		return err
+	}
+
+	l, err := s.listenLocked(protocol, endpoint)
+	if err != nil {
+		return err
+	}
+	s.httpServer = &http.Server{Handler: s.mux}
+	go s.httpServer.Serve(l)
+
+	return nil
+}
 
-	rpc.Register(ns)
-	rpc.HandleHTTP()
+// loadStoreLocked restores the durable backlog store, once, when the first endpoint starts
+func (s *NotificationServer) loadStoreLocked() error {
 
-	go registrationHandler(clientRegisteredChan)
+	if s.BacklogStore == nil || s.storeLoaded {
+		return nil
+	}
+	if err := s.loadBacklogLocked(); err != nil {
+		return err
+	}
+	if err := s.loadScheduledLocked(); err != nil {
+		return err
+	}
+	if err := s.loadMessageIDLocked(); err != nil {
+		return err
+	}
+	s.storeLoaded = true
+
+	return nil
+}
 
-	l, err := net.Listen(protocol, endpoint)
+// serveRPC is the equivalent of rpc.Server.ServeHTTP, but keeps track of the hijacked
+// connections so that Shutdown can close them once their pending calls are answered
+func (s *NotificationServer) serveRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+
+	if !s.trackConn(conn) {
+		conn.Close()
+		return
+	}
+	defer s.untrackConn(conn)
+
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	s.rpcServerFor(s.newSession(s.peerClientID(req.TLS))).ServeConn(conn)
+}
+
+// trackConn records a connection served outside the http.Server so that Shutdown can wait
+// for it. It returns false if the server is closed.
+func (s *NotificationServer) trackConn(conn net.Conn) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.connWG.Add(1)
+
+	return true
+}
+
+func (s *NotificationServer) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.connWG.Done()
+}
+
+// InitServer creates a NotificationServer and starts it on the endpoint
+func InitServer(protocol string, endpoint string, registrationHandler registrationHandler) *NotificationServer {
+
+	s := NewNotificationServer(registrationHandler)
+
+	if err := s.Serve(protocol, endpoint); err != nil {
 		log.Fatal("listen error:", err)
 	}
-	go http.Serve(l, nil)
+
+	return s
+}
+
+// Register adds the client to the registry, so that messages sent to it are kept until its
+// first poll. It returns the ID of the client, issuing a new one if the client has none.
+func (s *NotificationServer) Register(client NotificationClient) (string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return "", ErrServerClosed
+	}
+
+	if client.ClientID == "" {
+		client.ClientID = newClientID()
+	}
+
+	s.updateClientLocked(s.clientEntryLocked(client.ClientID), client, false)
+
+	return client.ClientID, nil
 }
 
-func registerListner(listenerChan chan NotificationServiceMessage, client NotificationClient) {
+// updateClientLocked records the registration a client brought with Register or a poll and
+// publishes the lifecycle events it amounts to
+func (s *NotificationServer) updateClientLocked(entry *notificationClientEntry, client NotificationClient, poll bool) {
+
+	previous, registered := entry.info, entry.registered
 
-	clientID := client.ProcessID
-	// check if the map is create and create it if not then create it
-	if listenerMap == nil {
-		listenerMap = make(map[int]chan NotificationServiceMessage)
+	entry.info = client
+	entry.registered = true
+	entry.heartbeat = s.heartbeatInterval(client.HeartbeatInterval)
+	s.touchLocked(entry)
+	s.subscribeLocked(client.ClientID, entry, client.Topics)
+
+	switch {
+	case !registered:
+		s.publishLocked(ClientFirstRegistered, entry, NotificationServiceMessage{})
+	case poll:
+		s.publishLocked(ClientRepolled, entry, NotificationServiceMessage{})
+	}
+	if registered && !reflect.DeepEqual(previous.Properties, client.Properties) {
+		s.publishLocked(ClientPropertiesChanged, entry, NotificationServiceMessage{})
+	}
+}
+
+// clientEntryLocked returns the entry of the client, creating it if it does not exist yet
+func (s *NotificationServer) clientEntryLocked(clientID string) *notificationClientEntry {
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		entry = &notificationClientEntry{
+			info:     NotificationClient{ClientID: clientID},
+			backlog:  NewList(),
+			topics:   make(map[string]struct{}),
+			inflight: make(map[uint64]*inflightMessage),
+		}
+		s.clients[clientID] = entry
+		s.metrics.registrations++
+		entry.heartbeat = s.heartbeatInterval(0)
+		s.touchLocked(entry)
 	}
-	if backlogMap == nil {
-		backlogMap = make(map[int]*List)
+
+	return entry
+}
+
+// listen parks the long-poll of the client until there is a message for it
+func (s *NotificationServer) listen(client NotificationClient) NotificationServiceMessage {
+	reply, _ := s.listenContext(context.Background(), client, false)
+	return reply
+}
+
+// listenContext is listen for callers that can give up waiting, such as a WebSocket whose peer
+// has gone away. It returns the error of the context if it is done before a message arrives.
+// A streaming poll comes from a connection that pushes messages as they arrive, so unlike a new
+// long-poll it does not mean the client is done with the messages it was sent before.
+func (s *NotificationServer) listenContext(ctx context.Context, client NotificationClient, streaming bool) (NotificationServiceMessage, error) {
+
+	if client.ClientID == "" {
+		client.ClientID = newClientID()
 	}
-	if refreshTimerMap == nil {
-		refreshTimerMap = make(map[int]*time.Timer)
+
+	listenerChan := make(chan NotificationServiceMessage, 1)
+	start := time.Now()
+
+	s.registerListener(listenerChan, client, streaming)
+
+	select {
+	case reply := <-listenerChan:
+		s.metrics.observePollWait(reply.MessageType, time.Since(start))
+		reply.ClientID = client.ClientID
+		return reply, nil
+	case <-ctx.Done():
+		s.abandonListener(client.ClientID, listenerChan)
+		return NotificationServiceMessage{}, ctx.Err()
 	}
-	if clientPropertyMap == nil {
-		clientPropertyMap = make(map[int]map[string]any)
+}
+
+// abandonListener withdraws a poll that nobody waits for any more. A message handed to it in the
+// meantime goes back to the front of the backlog, unless the client acknowledges messages, in
+// which case it is already waiting to be redelivered.
+func (s *NotificationServer) abandonListener(clientID string, listenerChan chan NotificationServiceMessage) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if ok && entry.listener == listenerChan {
+		entry.stopRefreshTimer()
+		entry.listener = nil
+		return
 	}
 
-	// if the timer for the client exists, then stop it
-	if timer, ok := refreshTimerMap[clientID]; ok {
-		timer.Stop()
+	select {
+	case message := <-listenerChan:
+		if ok && message.ID != 0 && !entry.info.Acknowledge {
+			message.DeliveryAttempt--
+			entry.pushBacklogFront(message)
+			// appending the message would put it behind the ones queued since it left the store
+			if err := s.repersistBacklogLocked(entry); err != nil {
+				log.Printf("backlog store: cannot restore message %d of client %s: %v", message.ID, clientID, err)
+			}
+		}
+	default:
 	}
+}
+
+// registerListener parks the poll of the client, or answers it with DISCONNECTED if the server has been shut down
+func (s *NotificationServer) registerListener(listenerChan chan NotificationServiceMessage, client NotificationClient, streaming bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	delete(refreshTimerMap, clientID)
-	delete(listenerMap, clientID)
-	delete(clientPropertyMap, clientID)
+	if s.closed {
+		listenerChan <- NotificationServiceMessage{Message: getGobFromString("Disconnected"), MessageType: DISCONNECTED}
+		return
+	}
 
-	listenerMap[clientID] = listenerChan
-	clientPropertyMap[clientID] = client.Properties
+	clientID := client.ClientID
+	entry := s.clientEntryLocked(clientID)
 
-	if _, ok := backlogMap[clientID]; !ok {
-		backlogMap[clientID] = NewList()
+	// an earlier poll that is still outstanding is superseded by this one, release it
+	if entry.listener != nil {
+		s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString(supersededReason), MessageType: REFRESHTIMER})
 	}
 
-	//Set up a timer to send a refresh message to the client every 13 seconds
-	clientRefreshTimer := time.NewTimer(13 * time.Second)
-	refreshTimerMap[clientID] = clientRefreshTimer
+	entry.listener = listenerChan
+	s.updateClientLocked(entry, client, true)
+
+	// anything delivered earlier and not acknowledged before this poll has to be sent again
+	if !streaming {
+		s.requeueInflightLocked(entry)
+	}
 
-	//create a go routine to wait for the timer to expire and then send a refresh message to the client
-	go func(clientID int) {
-		<-clientRefreshTimer.C
-		m1 := NotificationServiceMessage{Message: getGobFromString("Refresh Timer"), MessageType: REFRESHTIMER}
-		go sendMessageToClient(clientID, m1)
-		delete(refreshTimerMap, clientID)
-	}(clientID)
+	// a paused client is told so at once if the server is configured to, otherwise its poll is
+	// held like any other until it is resumed or the refresh timer fires
+	if entry.paused && s.PauseReply && !streaming {
+		s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Paused"), MessageType: PAUSED})
+		return
+	}
 
 	//check if there are any messages in the backlog and send them to the client
-	processBacklog(clientID)
+	if s.processBacklogLocked(entry) {
+		return
+	}
+
+	//Set up a timer to send a refresh or timeout message to the client if nothing else arrives
+	timeout, releaseType := s.pollTimeout(client.PollTimeout)
+	entry.refreshTimer = time.AfterFunc(timeout, func() {
+		s.refresh(clientID, listenerChan, releaseType)
+	})
+}
+
+// pollTimeout returns how long a poll is held for the PollTimeout a client asked for, and the
+// type of the message that releases it: TIMEOUT if the client asked, REFRESHTIMER otherwise
+func (s *NotificationServer) pollTimeout(requested time.Duration) (time.Duration, int) {
+
+	if requested <= 0 {
+		return s.RefreshInterval, REFRESHTIMER
+	}
+
+	timeout := max(requested, minPollTimeout)
+	if s.MaxPollTimeout > 0 {
+		timeout = min(timeout, s.MaxPollTimeout)
+	}
+
+	return timeout, TIMEOUT
+}
+
+// refresh releases the poll with a REFRESHTIMER or TIMEOUT message if it is still waiting
+func (s *NotificationServer) refresh(clientID string, listenerChan chan NotificationServiceMessage, releaseType int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok || entry.listener != listenerChan {
+		return
+	}
+
+	if releaseType == TIMEOUT {
+		s.metrics.timeouts++
+		s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Poll Timeout"), MessageType: TIMEOUT})
+		return
+	}
+
+	s.metrics.refreshes++
+	s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Refresh Timer"), MessageType: REFRESHTIMER})
+}
+
+// processBacklogLocked hands the next message of the backlog to the waiting poll, unless the client is paused
+func (s *NotificationServer) processBacklogLocked(entry *notificationClientEntry) bool {
+	if entry.paused {
+		return false
+	}
+	if message, hasBacklog := s.takeBacklogLocked(entry); hasBacklog {
+		s.deliverLocked(entry, message)
+		return true
+	}
+	return false
+}
+
+// takeBacklogLocked removes the next message to deliver from the backlog. Unless the client
+// acknowledges messages, the message is done with once it leaves the backlog.
+func (s *NotificationServer) takeBacklogLocked(entry *notificationClientEntry) (NotificationServiceMessage, bool) {
+	message, ok := s.nextBacklogLocked(entry)
+	if ok && !entry.info.Acknowledge {
+		s.unpersistLocked(entry.info.ClientID, message.ID)
+	}
+	return message, ok
+}
+
+// deliverLocked hands the message to the pending poll of the client. The listener channel has
+// room for exactly one message and is detached here, so this never blocks.
+func (s *NotificationServer) deliverLocked(entry *notificationClientEntry, message NotificationServiceMessage) {
+	entry.stopRefreshTimer()
+	entry.listener <- s.markDeliveredLocked(entry, message)
+	entry.listener = nil
+}
+
+// markDeliveredLocked counts the delivery attempt and starts waiting for the acknowledgement
+func (s *NotificationServer) markDeliveredLocked(entry *notificationClientEntry, message NotificationServiceMessage) NotificationServiceMessage {
+	if message.ID != 0 {
+		message.DeliveryAttempt++
+		if entry.info.Acknowledge {
+			s.trackInflightLocked(entry, message)
+		}
+		s.publishLocked(ClientMessageDelivered, entry, message)
+	}
+	return message
 }
 
-func processBacklog(clientID int) {
-	if backlogMessage, hasBacklog := backlogMap[clientID].FrontPop(); hasBacklog {
-		sendMessageToClient(clientID, backlogMessage.Value.(NotificationServiceMessage))
+// assignIDLocked gives a message passed to one of the send APIs its server-wide ID
+func (s *NotificationServer) assignIDLocked(message *NotificationServiceMessage) {
+	if message.ID == 0 {
+		s.lastMessageID++
+		message.ID = s.lastMessageID
+		if s.lastMessageID > s.reservedID {
+			s.reserveMessageIDsLocked()
+		}
 	}
 }
 
-func SendMessageToClient(clientID int, message NotificationServiceMessage) {
-	sendMessageToClient(clientID, message)
+func (s *NotificationServer) SendMessageToClient(clientID string, message NotificationServiceMessage) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignIDLocked(&message)
+
+	return s.sendMessageToClientLocked(clientID, message)
+}
+
+// SendMessageToClientWithPriority sends the message with the given priority, so that it overtakes
+// lower priority messages waiting in the backlog of the client
+func (s *NotificationServer) SendMessageToClientWithPriority(clientID string, message NotificationServiceMessage, priority int) error {
+	message.Priority = priority
+	return s.SendMessageToClient(clientID, message)
+}
+
+// SendBroadcastMessage sends the message to every client that currently has a poll waiting.
+// A paused client queues it, and the error reports those whose backlog refused it.
+func (s *NotificationServer) SendBroadcastMessage(message NotificationServiceMessage) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignIDLocked(&message)
+
+	return s.broadcastLocked(message)
 }
 
-func SendBroadcastMessage(message NotificationServiceMessage) {
-	for clientID := range listenerMap {
-		sendMessageToClient(clientID, message)
+func (s *NotificationServer) broadcastLocked(message NotificationServiceMessage) error {
+
+	var errs []error
+	for _, entry := range s.clients {
+		if entry.listener == nil {
+			continue
+		}
+		if err := s.sendToEntryLocked(entry, message); err != nil {
+			errs = append(errs, err)
+		}
 	}
+
+	return errors.Join(errs...)
 }
 
-func SendMessageToClients(clientIDs []int, message NotificationServiceMessage) {
+func (s *NotificationServer) SendMessageToClients(clientIDs []string, message NotificationServiceMessage) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignIDLocked(&message)
+
+	return s.sendMessageToClientsLocked(clientIDs, message)
+}
+
+func (s *NotificationServer) sendMessageToClientsLocked(clientIDs []string, message NotificationServiceMessage) error {
+
+	var errs []error
 	for _, clientID := range clientIDs {
-		sendMessageToClient(clientID, message)
+		if err := s.sendMessageToClientLocked(clientID, message); err != nil {
+			errs = append(errs, err)
+		}
 	}
+
+	return errors.Join(errs...)
+}
+
+func (s *NotificationServer) sendMessageToClientLocked(clientID string, message NotificationServiceMessage) error {
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return ErrUnknownClient
+	}
+
+	return s.sendToEntryLocked(entry, message)
 }
 
-func sendMessageToClient(clientID int, message NotificationServiceMessage) {
+// sendToEntryLocked delivers the message to the waiting poll of the client or queues it. A message
+// is persisted if it is queued, or if it is delivered but still has to be acknowledged. Messages
+// for a paused client are queued even if it has a poll waiting.
+func (s *NotificationServer) sendToEntryLocked(entry *notificationClientEntry, message NotificationServiceMessage) error {
+
+	if message.Expired(time.Now()) {
+		s.metrics.countDroppedLocked(dropExpired, 1)
+		return nil
+	}
+
+	deliver := entry.listener != nil && !entry.paused
 
-	if l, ok := listenerMap[clientID]; ok {
-		delete(listenerMap, clientID)
-		l <- message
+	if !deliver {
+		if ok, err := s.makeRoomLocked(entry, message); !ok {
+			s.metrics.countDroppedLocked(dropOverflow, 1)
+			s.publishLocked(ClientBacklogOverflow, entry, message)
+			return err
+		}
+	}
+
+	if !deliver || entry.info.Acknowledge {
+		if err := s.persistLocked(entry.info.ClientID, message); err != nil {
+			return err
+		}
+	}
+
+	if deliver {
+		s.deliverLocked(entry, message)
 	} else {
-		backlogMap[clientID].PushBack(message)
+		entry.pushBacklog(message)
+	}
+	s.metrics.countSentLocked(message.MessageType)
+
+	return nil
+}
+
+// ClearBacklog discards all messages queued for the client, including those waiting to be acknowledged
+func (s *NotificationServer) ClearBacklog(clientID string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.clients[clientID]; ok {
+		entry.clearBacklog()
+		entry.stopInflightTimers()
+		entry.inflight = make(map[uint64]*inflightMessage)
+		s.clearPersistedLocked(clientID)
+	}
+}
+
+// Disconnect forgets the client, its backlog and its scheduled messages. A poll that is still waiting is released with a DISCONNECTED message.
+func (s *NotificationServer) Disconnect(clientID string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disconnectLocked(clientID)
+}
+
+func (s *NotificationServer) disconnectLocked(clientID string) {
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return
+	}
+
+	if entry.listener != nil {
+		s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Disconnected"), MessageType: DISCONNECTED})
+	}
+	entry.stopRefreshTimer()
+	entry.stopInflightTimers()
+	entry.stopExpiryTimer()
+	s.clearPersistedLocked(clientID)
+	s.dropScheduledLocked(clientID)
+
+	s.unsubscribeAllLocked(clientID, entry)
+	delete(s.clients, clientID)
+	s.metrics.disconnects++
+	s.publishLocked(ClientDisconnected, entry, NotificationServiceMessage{})
+}
+
+// newClientID returns a random opaque identifier for a client that did not bring its own
+func newClientID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("qsutils: cannot generate client ID: " + err.Error())
 	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,63 @@
+package qsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollTimeoutBounds(t *testing.T) {
+
+	tests := []struct {
+		requested, max time.Duration
+		want           time.Duration
+		wantType       int
+	}{
+		{0, time.Minute, defaultRefreshInterval, REFRESHTIMER},
+		{time.Millisecond, time.Minute, minPollTimeout, TIMEOUT},
+		{5 * time.Second, time.Minute, 5 * time.Second, TIMEOUT},
+		{time.Hour, time.Minute, time.Minute, TIMEOUT},
+		{time.Hour, 0, time.Hour, TIMEOUT},
+	}
+
+	for _, test := range tests {
+		s := NewNotificationServer(nil)
+		s.MaxPollTimeout = test.max
+
+		timeout, releaseType := s.pollTimeout(test.requested)
+		if timeout != test.want || releaseType != test.wantType {
+			t.Errorf("pollTimeout(%v) with MaxPollTimeout %v = %v %s, want %v %s", test.requested, test.max,
+				timeout, MessageTypeName(releaseType), test.want, MessageTypeName(test.wantType))
+		}
+	}
+}
+
+func TestPollReleasedWithTimeoutAtMaxPollTimeout(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.MaxPollTimeout = minPollTimeout
+
+	client := NotificationClient{ClientID: "a", PollTimeout: time.Hour}
+	var registration NotificationRegistration
+	if err := s.service.Register(client, &registration); err != nil {
+		t.Fatal(err)
+	}
+	if registration.PollTimeout != minPollTimeout {
+		t.Fatalf("registration reports PollTimeout %v, want MaxPollTimeout %v", registration.PollTimeout, minPollTimeout)
+	}
+
+	start := time.Now()
+	replies := make(chan NotificationServiceMessage, 1)
+	go func() { replies <- s.listen(client) }()
+
+	select {
+	case message := <-replies:
+		if message.MessageType != TIMEOUT {
+			t.Fatalf("poll released with %s, want TIMEOUT", MessageTypeName(message.MessageType))
+		}
+		if elapsed := time.Since(start); elapsed > 3*minPollTimeout {
+			t.Fatalf("poll held for %v, beyond MaxPollTimeout %v", elapsed, minPollTimeout)
+		}
+	case <-time.After(5 * minPollTimeout):
+		t.Fatal("poll not released at MaxPollTimeout")
+	}
+}
@@ -0,0 +1,120 @@
+package qsutils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// BacklogSink receives the messages that were still queued for a client when the server shut down
+type BacklogSink func(clientID string, backlog []NotificationServiceMessage) error
+
+// Shutdown stops the server. It stops accepting connections, answers every pending long-poll
+// with a DISCONNECTED message, stops all refresh timers and hands the remaining backlogs to
+// ShutdownSink if one is set. A backlog the sink accepts is removed from BacklogStore, one it
+// returns an error for is left there. Scheduled messages that have not fired are kept only by a
+// durable backlog store. It waits for open RPC connections to finish answering their calls until
+// the context expires.
+func (s *NotificationServer) Shutdown(ctx context.Context) error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	close(s.closing)
+
+	if s.scheduleTimer != nil {
+		s.scheduleTimer.Stop()
+	}
+
+	backlogs := make(map[string][]NotificationServiceMessage)
+	for clientID, entry := range s.clients {
+		entry.stopRefreshTimer()
+		entry.stopExpiryTimer()
+		// unacknowledged messages were never confirmed, so they count as backlog
+		entry.stopInflightTimers()
+		inflight := entry.inflightInOrder()
+		for i := len(inflight) - 1; i >= 0; i-- {
+			entry.pushBacklogFront(inflight[i])
+		}
+		if entry.listener != nil {
+			s.deliverLocked(entry, NotificationServiceMessage{Message: getGobFromString("Disconnected"), MessageType: DISCONNECTED})
+		}
+		if s.ShutdownSink != nil && entry.backlog.Len() > 0 {
+			backlogs[clientID] = entry.drainBacklog()
+		}
+		s.publishLocked(ClientDisconnected, entry, NotificationServiceMessage{})
+	}
+	s.closeEventsLocked()
+	s.clients = make(map[string]*notificationClientEntry)
+	s.topics = make(map[string]map[string]struct{})
+
+	httpServer := s.httpServer
+	for _, l := range s.jsonListeners {
+		l.Close()
+	}
+
+	// RPC and WebSocket connections are hijacked and JSON-RPC connections have their own
+	// listener, so the http.Server does not know about them. Expiring the read deadline makes
+	// each connection stop reading new calls; net/rpc then waits for the calls in progress to
+	// write their replies before closing it.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	var errs []error
+
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := s.waitForConns(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	// a backlog the sink has taken is no longer the server's to deliver after a restart
+	for clientID, backlog := range backlogs {
+		if err := s.ShutdownSink(clientID, backlog); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.mu.Lock()
+		s.clearPersistedLocked(clientID)
+		s.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// waitForConns waits for the connections served outside the http.Server to close, closing any left when the context expires
+func (s *NotificationServer) waitForConns(ctx context.Context) error {
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		conns := make([]net.Conn, 0, len(s.conns))
+		for conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.mu.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,127 @@
+package qsutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+var ErrClientIDMismatch = errors.New("client ID does not match the client certificate")
+
+// NewServerTLSConfig loads the certificate and key of the server. If clientCAFile is not empty,
+// clients must present a certificate signed by one of the CAs in it.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// NewClientTLSConfig builds the TLS configuration of a client. caFile, if not empty, replaces the
+// system roots for verifying the server; certFile and keyFile, if not empty, are the client
+// certificate for mutual TLS; serverName, if not empty, overrides the host name that is verified.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// CertificateCommonName uses the common name of the certificate subject as the client ID
+func CertificateCommonName(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+
+	return pool, nil
+}
+
+// listenLocked opens a listener for an endpoint of the server, with TLS if it is configured
+func (s *NotificationServer) listenLocked(protocol, endpoint string) (net.Listener, error) {
+
+	l, err := net.Listen(protocol, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.TLSConfig != nil {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+
+	return l, nil
+}
+
+// peerClientID returns the client ID named by the verified certificate of a connection, or an
+// empty string if there is none or the server does not take client IDs from certificates
+func (s *NotificationServer) peerClientID(state *tls.ConnectionState) string {
+
+	if s.ClientIDFromCertificate == nil || state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	return s.ClientIDFromCertificate(state.VerifiedChains[0][0])
+}
+
+// connPeerClientID completes the TLS handshake of a connection accepted by the server and returns the client ID of its certificate
+func (s *NotificationServer) connPeerClientID(conn net.Conn) (string, error) {
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	state := tlsConn.ConnectionState()
+
+	return s.peerClientID(&state), nil
+}
@@ -0,0 +1,160 @@
+package qsutils
+
+import (
+	"errors"
+	"sort"
+)
+
+// Subscribe adds the topics to the subscriptions of the client. The client is registered if it is not known yet.
+func (t *NotificationService) Subscribe(subscription NotificationSubscription, reply *NotificationSubscription) error {
+
+	clientID, err := t.clientID(subscription.ClientID)
+	if err != nil {
+		return err
+	}
+
+	topics, err := t.server.Subscribe(clientID, subscription.Topics...)
+	if err != nil {
+		return err
+	}
+	reply.ClientID = clientID
+	reply.Topics = topics
+
+	return nil
+}
+
+// Unsubscribe removes the topics from the subscriptions of the client
+func (t *NotificationService) Unsubscribe(subscription NotificationSubscription, reply *NotificationSubscription) error {
+
+	clientID, err := t.clientID(subscription.ClientID)
+	if err != nil {
+		return err
+	}
+
+	topics, err := t.server.Unsubscribe(clientID, subscription.Topics...)
+	if err != nil {
+		return err
+	}
+	reply.ClientID = clientID
+	reply.Topics = topics
+
+	return nil
+}
+
+// Subscribe adds the topics to the subscriptions of the client and returns all of its topics
+func (s *NotificationServer) Subscribe(clientID string, topics ...string) ([]string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+
+	entry := s.clientEntryLocked(clientID)
+	s.subscribeLocked(clientID, entry, topics)
+
+	return entry.topicList(), nil
+}
+
+// Unsubscribe removes the topics from the subscriptions of the client and returns the topics left
+func (s *NotificationServer) Unsubscribe(clientID string, topics ...string) ([]string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.clients[clientID]
+	if !ok {
+		return nil, ErrUnknownClient
+	}
+
+	for _, topic := range topics {
+		s.unsubscribeLocked(clientID, entry, topic)
+	}
+
+	return entry.topicList(), nil
+}
+
+// Subscribers returns the IDs of the clients subscribed to the topic
+func (s *NotificationServer) Subscribers(topic string) []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientIDs := make([]string, 0, len(s.topics[topic]))
+	for clientID := range s.topics[topic] {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+
+	return clientIDs
+}
+
+// SendToTopic sends the message to every client subscribed to the topic. Subscribers that are
+// between polls get the message from their backlog on the next poll.
+func (s *NotificationServer) SendToTopic(topic string, message NotificationServiceMessage) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+
+	s.assignIDLocked(&message)
+
+	return s.sendToTopicLocked(topic, message)
+}
+
+func (s *NotificationServer) sendToTopicLocked(topic string, message NotificationServiceMessage) error {
+
+	message.Topic = topic
+
+	var errs []error
+	for clientID := range s.topics[topic] {
+		if err := s.sendMessageToClientLocked(clientID, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *NotificationServer) subscribeLocked(clientID string, entry *notificationClientEntry, topics []string) {
+	for _, topic := range topics {
+		if topic == "" {
+			continue
+		}
+		entry.topics[topic] = struct{}{}
+		if _, ok := s.topics[topic]; !ok {
+			s.topics[topic] = make(map[string]struct{})
+		}
+		s.topics[topic][clientID] = struct{}{}
+	}
+}
+
+func (s *NotificationServer) unsubscribeLocked(clientID string, entry *notificationClientEntry, topic string) {
+	delete(entry.topics, topic)
+	if subscribers, ok := s.topics[topic]; ok {
+		delete(subscribers, clientID)
+		if len(subscribers) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+}
+
+func (s *NotificationServer) unsubscribeAllLocked(clientID string, entry *notificationClientEntry) {
+	for topic := range entry.topics {
+		s.unsubscribeLocked(clientID, entry, topic)
+	}
+}
+
+// topicList returns the topics of the client in sorted order
+func (c *notificationClientEntry) topicList() []string {
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
@@ -0,0 +1,49 @@
+package qsutils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSendToTopicReportsFullBacklog(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.MaxBacklogMessages = 1
+	s.OverflowPolicy = RejectWithError
+
+	for _, clientID := range []string{"full", "empty"} {
+		if _, err := s.Subscribe(clientID, "news"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SendMessageToClient("full", NotificationServiceMessage{Message: getGobFromString("first")}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.SendToTopic("news", NotificationServiceMessage{Message: getGobFromString("second")})
+	if !errors.Is(err, ErrBacklogFull) {
+		t.Fatalf("SendToTopic returned %v, want ErrBacklogFull", err)
+	}
+
+	backlog, err := s.Backlog("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != 1 || backlog[0].Topic != "news" {
+		t.Fatalf("subscriber with room has backlog %v, want the topic message", backlog)
+	}
+}
+
+func TestSendToTopicWithRoom(t *testing.T) {
+
+	s := NewNotificationServer(nil)
+	s.MaxBacklogMessages = 1
+	s.OverflowPolicy = RejectWithError
+
+	if _, err := s.Subscribe("a", "news"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendToTopic("news", NotificationServiceMessage{Message: getGobFromString("only")}); err != nil {
+		t.Fatalf("SendToTopic returned %v", err)
+	}
+}
@@ -0,0 +1,496 @@
+package qsutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes and close codes from RFC 6455
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+	wsCloseInternalError = 1011
+)
+
+const (
+	webSocketGUID                = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxWebSocketMessage          = 16 << 20
+	webSocketRegistrationTimeout = 10 * time.Second
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+var errWebSocketTooBig = errors.New("websocket message too big")
+
+// WebSocketCommand is a frame sent by a WebSocket client after its registration
+type WebSocketCommand struct {
+	Ack         []uint64 `json:"ack,omitempty"`
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
+
+// EnableWebSocket serves the notification stream to WebSocket clients at path, next to the RPC
+// endpoint. WebSocket clients share the registry, backlogs and targeting of RPC clients.
+//
+// The first text frame a client sends is its registration, a JSON NotificationClient. The server
+// answers with a REGISTERED message carrying the ClientID, then sends every message for the
+// client as a JSON NotificationServiceMessage in its own text frame. Control messages such as
+// REGISTERED or REFRESHTIMER carry plain text with ContentTypeText. After that the client
+// sends a JSON WebSocketCommand to acknowledge messages or change its subscriptions.
+func (s *NotificationServer) EnableWebSocket(path string) {
+	s.mux.HandleFunc(path, s.serveWebSocket)
+}
+
+func (s *NotificationServer) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+
+	session, err := s.requestSession(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, req)
+	if err != nil {
+		return
+	}
+	if !s.trackConn(conn.conn) {
+		conn.close(wsCloseGoingAway, "server closed")
+		return
+	}
+	defer s.untrackConn(conn.conn)
+	defer conn.conn.Close()
+
+	client, err := s.registerWebSocket(conn, session)
+	if err != nil {
+		log.Print("websocket registration from ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+		s.readWebSocketCommands(conn, client.ClientID)
+	}()
+
+	s.pushWebSocket(ctx, conn, client)
+}
+
+// registerWebSocket reads the registration of the client and confirms it
+func (s *NotificationServer) registerWebSocket(conn *wsConn, session *clientSession) (NotificationClient, error) {
+
+	var client NotificationClient
+
+	conn.conn.SetReadDeadline(time.Now().Add(webSocketRegistrationTimeout))
+	_, data, err := conn.readMessage()
+	if err != nil {
+		conn.closeWithError(err)
+		return client, err
+	}
+	if err := json.Unmarshal(data, &client); err != nil {
+		conn.close(wsCloseProtocolError, "invalid registration")
+		return client, err
+	}
+	conn.conn.SetReadDeadline(time.Time{})
+
+	if client, err = session.authorizeClient(client); err != nil {
+		conn.close(wsClosePolicy, err.Error())
+		return client, err
+	}
+
+	clientID, err := s.Register(client)
+	if err != nil {
+		conn.close(wsCloseGoingAway, err.Error())
+		return client, err
+	}
+	client.ClientID = clientID
+
+	// subscriptions are only taken from the registration, later polls must not undo an Unsubscribe
+	client.Topics = nil
+
+	registered := textControlMessage("Registered", REGISTERED, clientID)
+	if err := conn.writeJSON(registered); err != nil {
+		return client, err
+	}
+
+	return client, nil
+}
+
+// pushWebSocket polls for the client on behalf of the socket until either side goes away
+func (s *NotificationServer) pushWebSocket(ctx context.Context, conn *wsConn, client NotificationClient) {
+
+	// the first poll of a connection redelivers what the previous one left unacknowledged
+	streaming := false
+
+	for {
+		if s.disabled.Load() {
+			disabled := textControlMessage("Disabled", DISABLED, client.ClientID)
+			if conn.writeJSON(disabled) != nil || sleepContext(ctx, s.RefreshInterval) != nil {
+				return
+			}
+			continue
+		}
+
+		message, err := s.listenContext(ctx, client, streaming)
+		if err != nil {
+			return
+		}
+		streaming = true
+
+		// a newer connection for the same client has taken over
+		if message.MessageType == REFRESHTIMER && getStringFromGob(message.Message) == supersededReason {
+			conn.close(wsClosePolicy, supersededReason)
+			return
+		}
+
+		if err := conn.writeJSON(textControl(message)); err != nil {
+			return
+		}
+
+		if message.MessageType == DISCONNECTED {
+			conn.close(wsCloseGoingAway, "disconnected")
+			return
+		}
+	}
+}
+
+// readWebSocketCommands applies the commands sent by the client until the socket is closed
+func (s *NotificationServer) readWebSocketCommands(conn *wsConn, clientID string) {
+
+	for {
+		_, data, err := conn.readMessage()
+		if err != nil {
+			conn.closeWithError(err)
+			return
+		}
+
+		var command WebSocketCommand
+		if err := json.Unmarshal(data, &command); err != nil {
+			conn.close(wsCloseProtocolError, "invalid command")
+			return
+		}
+
+		if len(command.Ack) > 0 {
+			s.Ack(clientID, command.Ack...)
+		}
+		if len(command.Subscribe) > 0 {
+			if _, err := s.Subscribe(clientID, command.Subscribe...); err != nil {
+				conn.close(wsCloseGoingAway, err.Error())
+				return
+			}
+		}
+		if len(command.Unsubscribe) > 0 {
+			s.Unsubscribe(clientID, command.Unsubscribe...)
+		}
+	}
+}
+
+// upgradeWebSocket performs the server side of the opening handshake. If the request is not a
+// valid upgrade the error response has been written.
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+
+	if req.Method != http.MethodGet || !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errWebSocketProtocol
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errWebSocketProtocol
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errWebSocketProtocol
+	}
+
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("websocket hijacking ", req.RemoteAddr, ": ", err.Error())
+		return nil, err
+	}
+
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+webSocketAccept(key)+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether the comma separated header contains token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is one end of a WebSocket connection. Reads must come from a single goroutine, writes
+// may come from any.
+type wsConn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	client      bool          // frames written by the client end are masked
+	readTimeout time.Duration // if set, the longest wait for any frame, see WebSocketListener.ServerTimeout
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readMessage returns the next text or binary message, reassembling fragments and answering
+// pings. A close frame from the peer is answered and reported as io.EOF.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+
+	var opcode byte
+	var message []byte
+
+	for {
+		if c.readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code := uint16(wsCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			c.close(code, "")
+			return 0, nil, io.EOF
+		case wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, errWebSocketProtocol
+			}
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return 0, nil, errWebSocketProtocol
+			}
+			opcode = op
+		default:
+			return 0, nil, errWebSocketProtocol
+		}
+
+		if len(message)+len(payload) > maxWebSocketMessage {
+			return 0, nil, errWebSocketTooBig
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	// no extensions are negotiated, and only frames from the client are masked
+	if header[0]&0x70 != 0 || masked == c.client {
+		err = errWebSocketProtocol
+		return
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		err = errWebSocketProtocol
+		return
+	}
+	if length > maxWebSocketMessage {
+		err = errWebSocketTooBig
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+
+	return
+}
+
+// close sends a close frame, unless one has been sent already, and closes the connection
+func (c *wsConn) close(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.writeFrame(wsOpClose, append(payload, reason...))
+	c.conn.Close()
+}
+
+// closeWithError closes the connection with the close code matching a read error
+func (c *wsConn) closeWithError(err error) {
+	switch {
+	case errors.Is(err, errWebSocketProtocol):
+		c.close(wsCloseProtocolError, err.Error())
+	case errors.Is(err, errWebSocketTooBig):
+		c.close(wsCloseTooBig, err.Error())
+	case errors.Is(err, io.EOF):
+		c.conn.Close()
+	case isTimeout(err):
+		c.close(wsCloseGoingAway, "")
+	default:
+		c.close(wsCloseInternalError, "")
+	}
+}
+
+// keepAlive pings the peer every interval until done is closed, so that a live peer always has a pong to send
+func (c *wsConn) keepAlive(interval time.Duration, done <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if c.writeFrame(wsOpPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,407 @@
+package qsutils
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ NotificationSource = new(NotificationListener)
+var _ NotificationSource = new(WebSocketListener)
+
+// WebSocketListener receives the messages for a client from the WebSocket endpoint of the
+// server. Like NotificationListener it reconnects with backoff when the connection is lost and
+// keeps the client ID issued by the server.
+type WebSocketListener struct {
+	URL    string // ws:// or wss:// URL of the endpoint set up with EnableWebSocket
+	Client NotificationClient
+
+	// TLSConfig is used for wss:// URLs, nil uses the defaults
+	TLSConfig *tls.Config
+
+	MinBackoff time.Duration // delay before the first reconnect attempt
+	MaxBackoff time.Duration // upper bound of the reconnect delay
+
+	// ServerTimeout is how long the connection may carry no frame before the server is taken to
+	// be gone and the listener reconnects. The listener pings the server while it waits, so a
+	// live server always answers within it. NewWebSocketListener sets twice the default refresh
+	// interval of the server; zero waits forever.
+	ServerTimeout time.Duration
+
+	// OnStateChange is called from the goroutine calling Next whenever the connection state changes.
+	// err carries the reason for the change, if there is one.
+	OnStateChange func(state ConnectionState, err error)
+
+	mu           sync.Mutex
+	conn         *wsConn
+	state        ConnectionState
+	reconnecting bool
+	closed       bool
+}
+
+// NewWebSocketListener creates a listener for the WebSocket endpoint at rawURL
+func NewWebSocketListener(rawURL string) *WebSocketListener {
+	return &WebSocketListener{
+		URL:           rawURL,
+		Client:        NotificationClient{ProcessID: os.Getpid()},
+		MinBackoff:    defaultMinBackoff,
+		MaxBackoff:    defaultMaxBackoff,
+		ServerTimeout: 2 * defaultRefreshInterval,
+	}
+}
+
+// Next waits for the next message for this client, reconnecting as needed. It only returns an
+// error when the context is done or the listener is closed.
+func (l *WebSocketListener) Next(ctx context.Context) (NotificationServiceMessage, error) {
+
+	attempt := 0
+
+	for {
+		conn, err := l.connect(ctx)
+		if err == nil {
+			var message NotificationServiceMessage
+			message, err = l.read(ctx, conn)
+			if err == nil {
+				if message.MessageType == DISABLED {
+					l.setState(ListenerDisabled, nil)
+					continue
+				}
+				if message.MessageType == PAUSED {
+					l.setState(ListenerPaused, nil)
+					continue
+				}
+				l.setState(ListenerConnected, nil)
+				return message, nil
+			}
+			l.dropConn(conn, err)
+		}
+
+		if l.isClosed() {
+			return NotificationServiceMessage{}, ErrListenerClosed
+		}
+		if ctx.Err() != nil {
+			return NotificationServiceMessage{}, ctx.Err()
+		}
+		if err := sleepContext(ctx, backoffDelay(l.MinBackoff, l.MaxBackoff, attempt)); err != nil {
+			return NotificationServiceMessage{}, err
+		}
+		attempt++
+	}
+}
+
+// Ack acknowledges messages received by this client. It does nothing unless Client.Acknowledge is set.
+func (l *WebSocketListener) Ack(ctx context.Context, messageIDs ...uint64) error {
+	if !l.clientInfo().Acknowledge {
+		return nil
+	}
+	return l.send(WebSocketCommand{Ack: messageIDs})
+}
+
+// Subscribe adds topics to the subscriptions of this client. The topics are also added to
+// Client.Topics so that they are restored on the next connection.
+func (l *WebSocketListener) Subscribe(ctx context.Context, topics ...string) error {
+
+	l.mu.Lock()
+	for _, topic := range topics {
+		if !containsString(l.Client.Topics, topic) {
+			l.Client.Topics = append(l.Client.Topics, topic)
+		}
+	}
+	l.mu.Unlock()
+
+	return l.send(WebSocketCommand{Subscribe: topics})
+}
+
+// Unsubscribe removes topics from the subscriptions of this client
+func (l *WebSocketListener) Unsubscribe(ctx context.Context, topics ...string) error {
+
+	l.mu.Lock()
+	kept := l.Client.Topics[:0]
+	for _, topic := range l.Client.Topics {
+		if !containsString(topics, topic) {
+			kept = append(kept, topic)
+		}
+	}
+	l.Client.Topics = kept
+	l.mu.Unlock()
+
+	return l.send(WebSocketCommand{Unsubscribe: topics})
+}
+
+// Close closes the connection and makes any blocked Next return ErrListenerClosed
+func (l *WebSocketListener) Close() error {
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+
+	l.setState(ListenerClosed, nil)
+
+	if conn != nil {
+		conn.close(wsCloseNormal, "")
+	}
+	return nil
+}
+
+// ClientID returns the ID the server knows this client by
+func (l *WebSocketListener) ClientID() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Client.ClientID
+}
+
+// State returns the current connection state
+func (l *WebSocketListener) State() ConnectionState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// send writes a command on the current connection. Commands are not queued while disconnected;
+// subscriptions are sent again on the next connection and unacknowledged messages redelivered.
+func (l *WebSocketListener) send(command WebSocketCommand) error {
+
+	l.mu.Lock()
+	conn := l.conn
+	closed := l.closed
+	l.mu.Unlock()
+
+	switch {
+	case closed:
+		return ErrListenerClosed
+	case conn == nil:
+		return errors.New("websocket listener not connected")
+	}
+
+	return conn.writeJSON(command)
+}
+
+// read returns the next message on the connection, abandoning the connection if the context is
+// done first, or with ErrServerSilent if nothing arrives within ServerTimeout
+func (l *WebSocketListener) read(ctx context.Context, conn *wsConn) (NotificationServiceMessage, error) {
+
+	stop := context.AfterFunc(ctx, func() { conn.conn.Close() })
+	defer stop()
+
+	if conn.readTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go conn.keepAlive(conn.readTimeout/3, done)
+	}
+
+	var message NotificationServiceMessage
+	_, data, err := conn.readMessage()
+	if isTimeout(err) {
+		return message, ErrServerSilent
+	}
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(data, &message)
+
+	return message, err
+}
+
+// connect returns the current connection or dials and registers a new one
+func (l *WebSocketListener) connect(ctx context.Context) (*wsConn, error) {
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrListenerClosed
+	}
+	if l.conn != nil {
+		defer l.mu.Unlock()
+		return l.conn, nil
+	}
+	reconnecting := l.reconnecting
+	l.mu.Unlock()
+
+	if !reconnecting {
+		l.setState(ListenerConnecting, nil)
+	}
+
+	conn, err := dialWebSocket(ctx, l.URL, l.TLSConfig)
+	var registration NotificationServiceMessage
+	if err == nil {
+		conn.readTimeout = l.ServerTimeout
+		err = conn.writeJSON(l.clientInfo())
+		if err == nil {
+			registration, err = l.read(ctx, conn)
+		}
+		if err == nil && registration.MessageType != REGISTERED {
+			err = errors.New("websocket registration not confirmed: " + MessageTypeName(registration.MessageType))
+		}
+		if err != nil {
+			conn.conn.Close()
+		}
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.reconnecting = true
+		l.mu.Unlock()
+		l.setState(ListenerDisconnected, err)
+		return nil, err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		conn.close(wsCloseNormal, "")
+		return nil, ErrListenerClosed
+	}
+	l.conn = conn
+	l.Client.ClientID = registration.ClientID
+	l.reconnecting = false
+	l.mu.Unlock()
+
+	l.setState(ListenerConnected, nil)
+
+	return conn, nil
+}
+
+// dropConn closes the connection if it is still the current one
+func (l *WebSocketListener) dropConn(conn *wsConn, err error) {
+
+	l.mu.Lock()
+	current := l.conn == conn
+	if current {
+		l.conn = nil
+	}
+	closed := l.closed
+	l.mu.Unlock()
+
+	if current {
+		conn.conn.Close()
+		if !closed {
+			l.setState(ListenerDisconnected, err)
+		}
+	}
+}
+
+func (l *WebSocketListener) clientInfo() NotificationClient {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client := l.Client
+	client.Topics = append([]string(nil), l.Client.Topics...)
+	return client
+}
+
+func (l *WebSocketListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *WebSocketListener) setState(state ConnectionState, err error) {
+
+	l.mu.Lock()
+	changed := l.state != state
+	l.state = state
+	l.mu.Unlock()
+
+	if changed && l.OnStateChange != nil {
+		l.OnStateChange(state, err)
+	}
+}
+
+// dialWebSocket connects to a ws:// or wss:// URL and performs the client side of the opening handshake
+func dialWebSocket(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*wsConn, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", address)
+	case "wss":
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		}
+		d := tls.Dialer{Config: tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", address)
+	default:
+		return nil, errors.New("unsupported websocket scheme: " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is abandoned with the connection if the context is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err == nil && resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		err = errors.New("invalid Sec-WebSocket-Accept")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-websocket", Net: "tcp", Addr: conn.RemoteAddr(), Err: err}
+	}
+
+	return &wsConn{conn: conn, br: br, client: true}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
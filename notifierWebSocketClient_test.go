@@ -0,0 +1,39 @@
+package qsutils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketListenerDetectsSilentServer(t *testing.T) {
+
+	// a server that accepts the connection and then never sends a frame, not even a pong
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgradeWebSocket(w, req)
+		if err != nil {
+			return
+		}
+		defer conn.conn.Close()
+		<-release
+	}))
+	defer server.Close()
+
+	l := NewWebSocketListener("ws" + strings.TrimPrefix(server.URL, "http"))
+	if l.ServerTimeout <= 0 {
+		t.Fatalf("NewWebSocketListener leaves ServerTimeout at %v", l.ServerTimeout)
+	}
+	l.ServerTimeout = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := l.connect(ctx); !errors.Is(err, ErrServerSilent) {
+		t.Fatalf("connect returned %v, want ErrServerSilent", err)
+	}
+}